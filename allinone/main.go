@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	backend "github.com/ojgenbar/Colossus/backend/app"
+	backendutils "github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/config"
+	converter "github.com/ojgenbar/Colossus/converter/app"
+	converterutils "github.com/ojgenbar/Colossus/converter/utils"
+	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Config of both services. Storage and Queue override the ones of the services,
+// so they always share the objects and the messages.
+type Config struct {
+	Storage   config.Storage        `mapstructure:"storage"`
+	Queue     config.Queue          `mapstructure:"queue"`
+	Backend   backendutils.Config   `mapstructure:"backend"`
+	Converter converterutils.Config `mapstructure:"converter"`
+}
+
+func LoadConfig() (*Config, error) {
+	var cfg Config
+
+	err := config.Load("configs/main.yml", &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Backend.Storage = cfg.Storage
+	cfg.Backend.Queue = cfg.Queue
+	cfg.Converter.Storage = cfg.Storage
+	cfg.Converter.Queue = cfg.Queue
+	return &cfg, nil
+}
+
+func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Metrics of both services are served by the system server of the backend
+	converter.RegisterMetrics()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		backend.Run(ctx, &cfg.Backend)
+	}()
+	go func() {
+		defer wg.Done()
+		converter.Run(ctx, &cfg.Converter)
+	}()
+
+	wg.Wait()
+	log.Println("Graceful shutdown complete.")
+}
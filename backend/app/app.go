@@ -0,0 +1,190 @@
+// Package app serves the backend API and runs its reconciler, for the backend binary and the all-in-one one.
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	handlers "github.com/ojgenbar/Colossus/backend/internal"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/queue"
+	ginprometheus "github.com/zsais/go-gin-prometheus"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func PromMiddleware(c *gin.Context) string {
+	url := c.Request.URL.Path
+	for _, p := range c.Params {
+		if p.Key == "type" || p.Key == "file" || p.Key == "id" {
+			url = strings.Replace(url, p.Value, ":"+p.Key, 1)
+		}
+	}
+	return url
+}
+
+// Reconcile implements `backend reconcile`, which requeues tasks of raw images without processed objects.
+func Reconcile(ctx context.Context, cfg *utils.Config, args []string) {
+	defaults := handlers.NewReconcileOptions(cfg.Reconcile)
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", defaults.DryRun, "only log tasks which would be requeued")
+	grace := flags.Duration("grace", defaults.GracePeriod, "skip raw images uploaded within this period, 10m if not set")
+	ratePerSecond := flags.Float64("rate", defaults.RatePerSecond, "maximum requeued tasks per second, 10 if not set")
+	_ = flags.Parse(args)
+
+	store, err := handlers.NewObjectStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := handlers.NewJobStore(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The outbox file is locked by the running backend, so tasks are published directly
+	q, err := handlers.NewQueue(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %s\n", err)
+	}
+	publisher, err := q.Publisher()
+	if err != nil {
+		log.Fatalf("Failed to create publisher: %s\n", err)
+	}
+	defer publisher.Close()
+
+	reconciler := handlers.NewReconciler(cfg, store, jobs, func(ctx context.Context, msg *queue.Message) error {
+		return handlers.PublishTask(ctx, publisher, cfg, msg)
+	}, nil)
+	report, err := reconciler.Reconcile(ctx, handlers.ReconcileOptions{
+		GracePeriod:   *grace,
+		RatePerSecond: *ratePerSecond,
+		DryRun:        *dryRun,
+	})
+	log.Printf("Checked %d raw images, %d missing processed objects, %d requeued\n",
+		report.Checked, report.Missing, report.Requeued)
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+}
+
+// Run serves the main and system routers until ctx is canceled, then shuts them down gracefully.
+func Run(ctx context.Context, cfg *utils.Config) {
+	handlers.RegisterMetrics()
+
+	// Clients are created once and shared by all requests
+	store, err := handlers.NewObjectStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	health := handlers.NewStorageHealth(store, cfg.StorageHealth)
+	store = health.Store()
+	handlers.PrepareBuckets(cfg, store)
+
+	if cfg.Queue.Driver != queue.DriverMemory {
+		handlers.PrepareKafkaTopic(&cfg.Kafka)
+	}
+	q, err := handlers.NewQueue(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %s\n", err)
+	}
+	publisher, err := q.Publisher()
+	if err != nil {
+		log.Fatalf("Failed to create publisher: %s\n", err)
+	}
+
+	jobs, err := handlers.NewJobStore(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outbox, err := handlers.OpenOutbox(cfg.Outbox, publisher, func(msg *queue.Message, publishedAt time.Time, err error) {
+		handlers.ObserveTaskDelivery(cfg, msg, publishedAt, err)
+	})
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %s\n", err)
+	}
+	h := handlers.NewHandler(cfg, store, jobs, outbox, health)
+
+	p := ginprometheus.NewPrometheus("gin")
+	p.ReqCntURLLabelMappingFn = PromMiddleware
+
+	routerMain := gin.Default()
+	p.Use(routerMain)
+
+	routerMain.GET("/healthz", handlers.HandleHealthz)
+	routerMain.GET("/readyz", h.HandleReadyz)
+	routerMain.GET("/presets", h.HandlePresets)
+
+	// Routes using the storage fail fast while it is down
+	withStorage := routerMain.Group("", health.RequireStorage)
+	withStorage.POST("/upload-image", h.HandleFileUploadRaw)
+	withStorage.GET("/retrieve-image/:type/:file", h.HandleFileRetrieveUploadToBucket)
+	withStorage.GET("/jobs/:id", h.HandleJobStatus)
+	withStorage.GET("/images/:id", h.HandleImageRendition)
+	withStorage.GET("/images/:id/metadata", h.HandleImageMetadata)
+
+	routerSystem := gin.Default()
+	p.SetMetricsPath(routerSystem)
+
+	log.Printf("Main server addr is %s.\n", cfg.Servers.Main.Addr)
+	log.Printf("System server addr is %s.\n", cfg.Servers.System.Addr)
+	servers := []*http.Server{
+		{Addr: cfg.Servers.Main.Addr, Handler: routerMain},
+		{Addr: cfg.Servers.System.Addr, Handler: routerSystem},
+	}
+	for _, server := range servers {
+		go func() {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP server error: %v", err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	if cfg.Reconcile.IntervalMs > 0 {
+		// Requeued tasks go through the outbox like uploaded ones
+		reconciler := handlers.NewReconciler(cfg, store, jobs, func(_ context.Context, msg *queue.Message) error {
+			return outbox.Add(msg)
+		}, outbox.PendingKeys)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interval := time.Duration(cfg.Reconcile.IntervalMs) * time.Millisecond
+			reconciler.Run(ctx, interval, handlers.NewReconcileOptions(cfg.Reconcile))
+		}()
+	}
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		handlers.StartJobEventsConsumer(ctx, cfg, jobs)
+	}()
+	go func() {
+		defer wg.Done()
+		health.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		outbox.Run(ctx)
+	}()
+
+	<-ctx.Done()
+
+	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownRelease()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP shutdown error: %v", err)
+		}
+	}
+	log.Println("Graceful HTTP server shutdown complete.")
+
+	// Tasks still in the outbox are published after restart
+	wg.Wait()
+	publisher.Close()
+	if err := outbox.Close(); err != nil {
+		log.Printf("Failed to close outbox: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"strconv"
+)
+
+// ParseOutputSpec reads the format form fields of the request.
+// It returns nil if neither a format nor a poster frame is requested, so the processed image keeps the input format.
+// Errors keep their kind, so an unsupported format is reported as such.
+func ParseOutputSpec(c *gin.Context) (*imaging.OutputSpec, error) {
+	format := c.PostForm("format")
+	spec := imaging.OutputSpec{
+		Format:      format,
+		Compression: c.PostForm("compression"),
+	}
+	if poster := c.PostForm("poster"); poster != "" {
+		var err error
+		spec.Poster, err = strconv.ParseBool(poster)
+		if err != nil {
+			return nil, errs.Errorf(errs.Validation, "invalid poster %q", poster)
+		}
+	}
+	if format == "" {
+		if c.PostForm("quality") != "" || spec.Compression != "" {
+			return nil, errs.New(errs.Validation, "quality and compression require a format")
+		}
+		if !spec.Poster {
+			return nil, nil
+		}
+		return &imaging.OutputSpec{Poster: true}, nil
+	}
+
+	if quality := c.PostForm("quality"); quality != "" {
+		var err error
+		spec.Quality, err = strconv.Atoi(quality)
+		if err != nil {
+			return nil, errs.Errorf(errs.Validation, "invalid quality %q", quality)
+		}
+	}
+
+	err := spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
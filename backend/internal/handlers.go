@@ -7,98 +7,73 @@ import (
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/ojgenbar/Colossus/common/tasks"
 	"github.com/prometheus/client_golang/prometheus"
+	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func InitializeS3Client(s3cfg *utils.S3) (*minio.Client, error) {
-	endpoint := s3cfg.Auth.Endpoint
-	accessKeyID := s3cfg.Auth.AccessKeyID
-	secretAccessKey := s3cfg.Auth.SecretAccessKey
-
-	// Initialize minio client object.
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds: credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		//Secure: useSSL,
-	})
-	if err != nil {
-		log.Fatalln(err)
-		return nil, err
-	}
-	return minioClient, nil
+// Handler serves the API. Its dependencies are created once at startup and shared by all requests.
+type Handler struct {
+	cfg    *utils.Config
+	store  storage.ObjectStore
+	jobs   JobStore
+	outbox *Outbox
+	health *StorageHealth
 }
 
-func PrepareS3Buckets(s3cfg *utils.S3) {
-	PrepareS3Bucket(
-		s3cfg,
-		s3cfg.Buckets.Raw.Name,
-		s3cfg.Buckets.Raw.Location,
-	)
-	PrepareS3Bucket(
-		s3cfg,
-		s3cfg.Buckets.Processed.Name,
-		s3cfg.Buckets.Processed.Location,
-	)
+func NewHandler(cfg *utils.Config, store storage.ObjectStore, jobs JobStore, outbox *Outbox, health *StorageHealth) *Handler {
+	return &Handler{cfg: cfg, store: store, jobs: jobs, outbox: outbox, health: health}
 }
 
-func PrepareS3Bucket(s3cfg *utils.S3, name string, location string) {
-	ctx := context.Background()
-
-	minioClient, err := InitializeS3Client(s3cfg)
-	if err != nil {
-		panic(err)
-	}
-
-	err = minioClient.MakeBucket(ctx, name, minio.MakeBucketOptions{Region: location})
-	if err != nil {
-		// Check to see if we already own this bucket (which happens if you run this twice)
-		exists, errBucketExists := minioClient.BucketExists(ctx, name)
-		if errBucketExists == nil && exists {
-			log.Printf("We already own %s\n", name)
-		} else {
-			log.Fatalln(err)
-		}
-	} else {
-		log.Printf("Successfully created %s\n", name)
-	}
+// NewObjectStore returns the object storage selected by the config.
+func NewObjectStore(cfg *utils.Config) (storage.ObjectStore, error) {
+	return storage.New(&cfg.Storage, &cfg.S3)
 }
 
-func UploadToS3(s3cfg *utils.S3, objectName string, uploadedFile *multipart.FileHeader) (minio.UploadInfo, error) {
-	ctx := context.Background()
+func PrepareBuckets(cfg *utils.Config, store storage.ObjectStore) {
+	buckets := cfg.S3.Buckets
+	PrepareBucket(store, buckets.Raw)
+	PrepareBucket(store, buckets.Processed)
+	PrepareBucket(store, buckets.Jobs)
+	PrepareBucket(store, buckets.Renditions)
+}
 
-	// Initialize minio client object.
-	minioClient, err := InitializeS3Client(s3cfg)
+func PrepareBucket(store storage.ObjectStore, bucket config.S3Bucket) {
+	err := store.MakeBucket(context.Background(), bucket)
 	if err != nil {
 		log.Fatalln(err)
-		return minio.UploadInfo{}, err
 	}
+}
 
-	contentType := uploadedFile.Header.Get("Content-Type")
-
-	// Upload the zip file with FPutObject
+// UploadToStorage puts the uploaded file with the given content type, which should be the detected one.
+func UploadToStorage(ctx context.Context, store storage.ObjectStore, bucketName string, objectName string, uploadedFile *multipart.FileHeader, contentType string) (storage.ObjectInfo, error) {
 	f, err := uploadedFile.Open()
 	if err != nil {
-		return minio.UploadInfo{}, err
+		return storage.ObjectInfo{}, err
 	}
+	defer f.Close()
 
-	bucketName := s3cfg.Buckets.Raw.Name
-
-	info, err := minioClient.PutObject(
+	info, err := store.Put(
 		ctx, bucketName, objectName, f,
-		uploadedFile.Size, minio.PutObjectOptions{ContentType: contentType},
+		uploadedFile.Size, storage.PutOptions{ContentType: contentType},
 	)
 	if err != nil {
-		log.Fatalln(err)
-		return minio.UploadInfo{}, err
+		log.Println(err)
+		return storage.ObjectInfo{}, err
 	}
 
 	log.Printf("Successfully uploaded %s of size %d\n", objectName, info.Size)
@@ -107,37 +82,82 @@ func UploadToS3(s3cfg *utils.S3, objectName string, uploadedFile *multipart.File
 	return info, nil
 }
 
-func GenerateNamePair(fileName string) (fileNameRaw string, fileNameProcessed string) {
-	id := uuid.New()
+// GenerateNamePair returns names of the raw and the processed objects.
+// The processed one keeps the extension of the upload unless outputExt is set.
+func GenerateNamePair(fileName string, outputExt string) (id string, fileNameRaw string, fileNameProcessed string) {
+	id = uuid.New().String()
 	ext := filepath.Ext(fileName)
-	fileNameRaw = fmt.Sprintf("%s-raw%s", id, ext)
-	fileNameProcessed = fmt.Sprintf("%s-processed%s", id, ext)
-	return fileNameRaw, fileNameProcessed
+	if outputExt == "" {
+		outputExt = ext
+	}
+	return id, RawObjectName(id, ext), ProcessedObjectName(id, outputExt)
 }
 
-func RetrieveS3File(c *gin.Context, s3cfg *utils.S3, bucketName, objectName string) {
-	minioClient, err := InitializeS3Client(s3cfg)
-	if err != nil {
-		JsonErrorResponse(c, err, http.StatusInternalServerError)
+func RawObjectName(id string, ext string) string {
+	return fmt.Sprintf("%s-raw%s", id, ext)
+}
+
+// ProcessedObjectName returns the name of the single rendition, names of variants are
+// prefixed by it as well.
+func ProcessedObjectName(id string, ext string) string {
+	return fmt.Sprintf("%s-processed%s", id, ext)
+}
+
+// ParseRawObjectName returns the image id and the extension encoded by RawObjectName.
+func ParseRawObjectName(name string) (id string, ext string, ok bool) {
+	id, ext, ok = strings.Cut(name, "-raw")
+	if !ok {
+		return "", "", false
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return "", "", false
 	}
+	return id, ext, true
+}
 
-	objectInfo, err := minioClient.StatObject(context.Background(), bucketName, objectName, minio.GetObjectOptions{})
+func RetrieveStoredFile(c *gin.Context, store storage.ObjectStore, bucketName, objectName string) {
+	object, objectInfo, err := store.Get(c.Request.Context(), bucketName, objectName)
 	if err != nil {
-		log.Println(err)
-		JsonErrorResponse(c, err, http.StatusNotFound)
+		JsonErrorResponse(c, err)
 		return
 	}
+	defer object.Close()
 
-	object, err := minioClient.GetObject(context.Background(), bucketName, objectName, minio.GetObjectOptions{})
+	retrievedRawImages.WithLabelValues(bucketName).Inc()
+	c.DataFromReader(http.StatusOK, objectInfo.Size, objectInfo.ContentType, object, nil)
+}
+
+// RetrieveStrippedFile serves a JPEG, PNG or WebP image without its metadata, but the orientation
+// needed to display it upright. TIFF images keep their metadata in the image directory, so they are
+// refused. GIF and BMP images carry no EXIF and are served as they are.
+func RetrieveStrippedFile(c *gin.Context, store storage.ObjectStore, bucketName, objectName string) {
+	object, objectInfo, err := store.Get(c.Request.Context(), bucketName, objectName)
 	if err != nil {
-		log.Println(err)
-		JsonErrorResponse(c, err, http.StatusInternalServerError)
+		JsonErrorResponse(c, err)
 		return
 	}
 	defer object.Close()
 
+	format, err := imaging.FormatByMimeType(objectInfo.ContentType)
+	if err == nil && format.Name == "tiff" {
+		JsonErrorResponse(c, errs.New(errs.UnsupportedMedia, "metadata of TIFF images can not be stripped, download a processed image instead"))
+		return
+	}
+	data, err := io.ReadAll(object)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	if format != nil {
+		exif, err := imaging.ReadExif(data, format)
+		if err != nil {
+			log.Printf("Failed to read EXIF of %s: %s\n", objectName, err)
+		}
+		data = imaging.WithExif(data, format, exif.OrientationOnly())
+	}
+
 	retrievedRawImages.WithLabelValues(bucketName).Inc()
-	c.DataFromReader(http.StatusOK, objectInfo.Size, objectInfo.ContentType, object, nil)
+	c.Data(http.StatusOK, objectInfo.ContentType, data)
 }
 
 func PrepareKafkaTopic(cfg *utils.Kafka) {
@@ -163,10 +183,20 @@ func PrepareKafkaTopic(cfg *utils.Kafka) {
 		ctx,
 		// Multiple topics can be created simultaneously
 		// by providing more TopicSpecification structs here.
-		[]kafka.TopicSpecification{{
-			Topic:             cfg.Topic.Name,
-			NumPartitions:     cfg.Topic.NumPartitions,
-			ReplicationFactor: 1}},
+		[]kafka.TopicSpecification{
+			{
+				Topic:             cfg.Topic.Name,
+				NumPartitions:     cfg.Topic.NumPartitions,
+				ReplicationFactor: 1},
+			{
+				Topic:             cfg.StatusTopic.Name,
+				NumPartitions:     cfg.StatusTopic.NumPartitions,
+				ReplicationFactor: 1},
+			{
+				Topic:             cfg.ResultsTopic.Name,
+				NumPartitions:     cfg.ResultsTopic.NumPartitions,
+				ReplicationFactor: 1},
+		},
 		// Admin options
 		kafka.SetAdminOperationTimeout(maxDur))
 	if err != nil {
@@ -182,9 +212,41 @@ func PrepareKafkaTopic(cfg *utils.Kafka) {
 	a.Close()
 }
 
-func JsonErrorResponse(c *gin.Context, err error, status int) {
-	c.JSON(status, gin.H{
+// StatusCode returns the HTTP status matching the kind of err.
+func StatusCode(err error) int {
+	switch errs.KindOf(err) {
+	case errs.Validation:
+		return http.StatusBadRequest
+	case errs.NotFound:
+		return http.StatusNotFound
+	case errs.UnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case errs.TooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errs.Unprocessable:
+		return http.StatusUnprocessableEntity
+	case errs.StorageUnavailable, errs.QueueUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// cacheForever lets clients keep the response: renditions and metadata of an image never change once stored.
+func cacheForever(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// JsonErrorResponse answers with the status matching the kind of err. Unclassified errors are logged,
+// as they are not expected.
+func JsonErrorResponse(c *gin.Context, err error) {
+	kind := errs.KindOf(err)
+	if kind == errs.Internal {
+		log.Printf("%s %s: %s\n", c.Request.Method, c.Request.URL.Path, err)
+	}
+	c.JSON(StatusCode(err), gin.H{
 		"message": err.Error(),
+		"kind":    kind,
 		"error":   true,
 	})
 }
@@ -193,6 +255,13 @@ func RegisterMetrics() {
 	prometheus.MustRegister(uploadedRawImages)
 	prometheus.MustRegister(uploadedRawImagesToKafka)
 	prometheus.MustRegister(retrievedRawImages)
+	prometheus.MustRegister(jobStatusEvents)
+	prometheus.MustRegister(renditionRequests)
+	prometheus.MustRegister(taskPublishDuration)
+	prometheus.MustRegister(storageUp)
+	prometheus.MustRegister(outboxPending)
+	prometheus.MustRegister(outboxRelayed)
+	prometheus.MustRegister(reconciledImages)
 }
 
 var uploadedRawImages = prometheus.NewCounter(
@@ -210,6 +279,15 @@ var uploadedRawImagesToKafka = prometheus.NewCounterVec(
 	[]string{"partition", "client_id"},
 )
 
+var taskPublishDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "colossus_backend_task_publish_duration_seconds",
+		Help:    "Time from publishing a task until the broker acknowledges it, by result: ok or error",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"result"},
+)
+
 var retrievedRawImages = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "colossus_backend_retrieved_images",
@@ -224,63 +302,52 @@ func HandleHealthz(c *gin.Context) {
 	})
 }
 
-func PutInKafka(cfg *utils.Kafka, data *gin.H) (*kafka.Message, error) {
-	topic := cfg.Topic.Name
-	clientId := cfg.ClientId
-
-	p, err, message, err2 := createKafkaProducer(cfg, clientId)
-	if err2 != nil {
-		return message, err2
+// HandleReadyz reports whether the backend can serve requests, i.e. the storage is available.
+func (h *Handler) HandleReadyz(c *gin.Context) {
+	if !h.health.Available() {
+		JsonErrorResponse(c, ErrStorageUnavailable)
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+	})
+}
 
-	b, err := json.Marshal(data)
+// NewTaskMessage returns the message queuing the task for the converter.
+func NewTaskMessage(cfg *utils.Config, task *tasks.ConvertTask) (*queue.Message, error) {
+	b, err := json.Marshal(task)
 	if err != nil {
-		log.Fatalln(fmt.Sprintf("Failed to Marshall: %s\n", err), err)
 		return nil, err
 	}
 	log.Println(string(b))
+	// Keyed by the raw image, so the reconciler can tell a task of it is still in the outbox
+	return &queue.Message{Topic: cfg.Kafka.Topic.Name, Key: []byte(task.FilenameRaw), Value: b}, nil
+}
 
-	payload := b
-
-	deliveryChan := make(chan kafka.Event, 10000)
-	err = p.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-		Value:          payload},
-		deliveryChan,
-	)
-
-	e := <-deliveryChan
-	m := e.(*kafka.Message)
+// PublishTask publishes the task message and waits for the broker to acknowledge it.
+func PublishTask(ctx context.Context, publisher queue.Publisher, cfg *utils.Config, msg *queue.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := publisher.Publish(ctx, msg)
+	ObserveTaskDelivery(cfg, msg, start, err)
+	return err
+}
 
-	if m.TopicPartition.Error != nil {
-		log.Fatalln(fmt.Sprintf("Delivery failed: %v\n", m.TopicPartition.Error), err)
-		return nil, err
-	} else {
-		log.Printf("Delivered message to topic %s [%d] at offset %v\n",
-			*m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
+// ObserveTaskDelivery logs and counts the result of publishing the task message.
+func ObserveTaskDelivery(cfg *utils.Config, msg *queue.Message, publishedAt time.Time, err error) {
+	if err != nil {
+		taskPublishDuration.WithLabelValues("error").Observe(time.Since(publishedAt).Seconds())
+		log.Printf("Delivery failed: %v\n", err)
+		return
 	}
-	close(deliveryChan)
+	taskPublishDuration.WithLabelValues("ok").Observe(time.Since(publishedAt).Seconds())
+	log.Printf("Delivered message to topic %s [%d] at offset %v\n", msg.Topic, msg.Partition, msg.Offset)
 
 	uploadedRawImagesToKafka.WithLabelValues(
-		strconv.Itoa(int(m.TopicPartition.Partition)),
-		clientId,
+		strconv.Itoa(int(msg.Partition)),
+		cfg.Kafka.ClientId,
 	).Inc()
-
-	return m, nil
-}
-
-func createKafkaProducer(cfg *utils.Kafka, clientId string) (*kafka.Producer, error, *kafka.Message, error) {
-	p, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": cfg.BootstrapServers,
-		"client.id":         clientId,
-		"acks":              cfg.Acks,
-	})
-
-	if err != nil {
-		log.Fatalln(fmt.Sprintf("Failed to create producer: %s\n", err), err)
-		return nil, nil, nil, err
-	}
-	return p, err, nil, nil
 }
 
 func createKafkaAdminClient(cfg *utils.Kafka) (*kafka.AdminClient, error) {
@@ -289,65 +356,210 @@ func createKafkaAdminClient(cfg *utils.Kafka) (*kafka.AdminClient, error) {
 	})
 
 	if err != nil {
-		log.Fatalln(fmt.Sprintf("Failed to create admin client: %s\n", err), err)
 		return nil, err
 	}
 	return p, nil
 }
 
-func HandleFileUploadRaw(c *gin.Context) {
-	cfg := c.MustGet("cfg").(*utils.Config)
+func (h *Handler) HandleFileUploadRaw(c *gin.Context) {
+	cfg := h.cfg
+	store := h.jobs
 
+	LimitUploadBody(c.Writer, c.Request, &cfg.Uploads)
 	f, uploadedFile, err := c.Request.FormFile("file")
 	if err != nil {
-		JsonErrorResponse(c, err, http.StatusBadRequest)
+		JsonErrorResponse(c, FormFileError(err))
 		return
 	}
 
 	defer f.Close()
 
-	fileNameRaw, fileNameProcessed := GenerateNamePair(uploadedFile.Filename)
+	format, err := InspectUpload(&cfg.Uploads, f, uploadedFile)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	fileName := UploadFileName(uploadedFile.Filename, format)
+
+	resize, err := ParseResizeSpec(c)
+	if err != nil {
+		JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+		return
+	}
+	filter, err := ParseFilter(c)
+	if err != nil {
+		JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+		return
+	}
+	output, err := ParseOutputSpec(c)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	variantSpecs, err := ParseVariantSpecs(c, cfg)
+	if err != nil {
+		JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+		return
+	}
+	if variantSpecs != nil && (resize != nil || filter != "" || output != nil) {
+		JsonErrorResponse(c, errs.New(errs.Validation, "variants can not be combined with resize, filter or format fields"))
+		return
+	}
+
+	presetName := c.PostForm("preset")
+	if presetName != "" {
+		if variantSpecs != nil || resize != nil || filter != "" || output != nil {
+			JsonErrorResponse(c, errs.New(errs.Validation, "preset can not be combined with variants, resize, filter or format fields"))
+			return
+		}
+		preset, err := LookupPreset(cfg, presetName)
+		if err != nil {
+			JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+			return
+		}
+		options, err := NewConversionOptions(preset)
+		if err != nil {
+			// The preset comes from the config, not from the request
+			JsonErrorResponse(c, errs.Wrap(errs.Internal, fmt.Errorf("preset %q: %w", presetName, err)))
+			return
+		}
+		resize, filter, output = options.Resize, options.Filter, options.Output
+	}
+
+	var outputExt string
+	if output != nil {
+		outputExt = output.Extension()
+	}
+	jobId, fileNameRaw, fileNameProcessed := GenerateNamePair(fileName, outputExt)
+
+	// The file was partly read to detect its format
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	metadata, err := ExtractMetadata(jobId, f, format)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+
+	var variants []tasks.Variant
+	var jobVariants []JobVariant
+	for i := range variantSpecs {
+		variant, err := NewVariant(cfg, &variantSpecs[i], jobId, filepath.Ext(fileName))
+		if err != nil {
+			JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+			return
+		}
+		variants = append(variants, *variant)
+		jobVariants = append(jobVariants, JobVariant{Name: variant.Name, FilenameProcessed: variant.FilenameProcessed})
+	}
+	if len(variants) > 0 {
+		fileNameProcessed = variants[0].FilenameProcessed
+	}
+
+	info, err := UploadToStorage(c.Request.Context(), h.store, cfg.S3.Buckets.Raw.Name, fileNameRaw, uploadedFile, format.MimeType)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	err = StoreMetadata(c.Request.Context(), h.store, cfg.S3.Buckets.Raw.Name, metadata)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+
+	queuedAt := time.Now().UTC()
+	task := tasks.ConvertTask{
+		JobId:             jobId,
+		FilenameRaw:       fileNameRaw,
+		FilenameProcessed: fileNameProcessed,
+		Message:           "file uploaded successfully",
+		QueuedAt:          queuedAt,
+		Resize:            resize,
+		Filter:            filter,
+		Output:            output,
+		Preset:            presetName,
+		Variants:          variants,
+	}
+	job := Job{
+		Id:                jobId,
+		Status:            tasks.JobStatusQueued,
+		FilenameRaw:       fileNameRaw,
+		FilenameProcessed: fileNameProcessed,
+		Variants:          jobVariants,
+		CreatedAt:         queuedAt,
+		UpdatedAt:         queuedAt,
+		Task:              &task,
+	}
+	err = store.Create(c.Request.Context(), &job)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
 
-	info, err := UploadToS3(&cfg.S3, fileNameRaw, uploadedFile)
+	// The task is published by the outbox relay, so it is not lost if the broker is down
+	msg, err := NewTaskMessage(cfg, &task)
+	if err == nil {
+		err = errs.Wrap(errs.QueueUnavailable, h.outbox.Add(msg))
+	}
 	if err != nil {
-		JsonErrorResponse(c, err, http.StatusInternalServerError)
+		_ = ApplyJobStatusEvent(c.Request.Context(), store, &tasks.JobStatusEvent{
+			JobId:     jobId,
+			Status:    tasks.JobStatusFailed,
+			Error:     err.Error(),
+			Timestamp: time.Now().UTC(),
+		})
+		JsonErrorResponse(c, err)
 		return
 	}
 
 	data := gin.H{
-		"message":            "file uploaded successfully",
+		"message":            task.Message,
+		"job_id":             jobId,
 		"filename_raw":       fileNameRaw,
 		"filename_processed": fileNameProcessed,
-		"queued_at":          time.Now().UTC().Format(time.RFC3339),
+		"queued_at":          queuedAt.Format(time.RFC3339),
 		"info":               info,
+		"metadata":           metadata,
 	}
-
-	_, err = PutInKafka(&cfg.Kafka, &data)
-	if err != nil {
-		JsonErrorResponse(c, err, http.StatusInternalServerError)
-		return
+	if resize != nil {
+		data["resize"] = resize
+	}
+	if filter != "" {
+		data["filter"] = filter
+	}
+	if output != nil {
+		data["output"] = output
+	}
+	if variants != nil {
+		data["variants"] = variants
+	}
+	if presetName != "" {
+		data["preset"] = presetName
 	}
 
 	c.JSON(http.StatusOK, data)
 }
 
-func HandleFileRetrieveUploadToBucket(c *gin.Context) {
-	cfg := c.MustGet("cfg").(*utils.Config)
+func (h *Handler) HandleFileRetrieveUploadToBucket(c *gin.Context) {
+	cfg := h.cfg
 	type_ := c.Param("type")
 	file := c.Param("file")
 
 	var bucketName string
 	switch type_ {
 	case "raw":
+		if cfg.Downloads.StripRawMetadata {
+			RetrieveStrippedFile(c, h.store, cfg.S3.Buckets.Raw.Name, file)
+			return
+		}
 		bucketName = cfg.S3.Buckets.Raw.Name
 	case "processed":
 		bucketName = cfg.S3.Buckets.Processed.Name
 	default:
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": fmt.Sprintf("'%s' is not a valid type", type_),
-			"error":   true,
-		})
+		JsonErrorResponse(c, errs.Errorf(errs.Validation, "'%s' is not a valid type", type_))
 		return
 	}
-	RetrieveS3File(c, &cfg.S3, bucketName, file)
+	RetrieveStoredFile(c, h.store, bucketName, file)
 }
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"iter"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var ErrStorageUnavailable = errs.New(errs.StorageUnavailable, "storage is unavailable")
+
+// StorageHealth tracks availability of the object storage. The storage is pinged
+// periodically and right after an operation fails, so handlers may fail fast with
+// 503 while it is down instead of waiting for every request to time out.
+type StorageHealth struct {
+	store    storage.ObjectStore
+	interval time.Duration
+	timeout  time.Duration
+	up       atomic.Bool
+	recheck  chan struct{}
+}
+
+func NewStorageHealth(store storage.ObjectStore, cfg utils.StorageHealth) *StorageHealth {
+	interval := time.Duration(cfg.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	h := &StorageHealth{
+		store:    store,
+		interval: interval,
+		timeout:  timeout,
+		recheck:  make(chan struct{}, 1),
+	}
+	// Until the first check, the storage is assumed to be up
+	h.up.Store(true)
+	storageUp.Set(1)
+	return h
+}
+
+// Run checks the storage until ctx is canceled.
+func (h *StorageHealth) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.recheck:
+		}
+	}
+}
+
+func (h *StorageHealth) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	err := h.store.Ping(ctx)
+	up := err == nil
+	if h.up.Swap(up) != up {
+		if up {
+			log.Println("Storage is available again")
+		} else {
+			log.Printf("Storage is unavailable: %s\n", err)
+		}
+	}
+	if up {
+		storageUp.Set(1)
+	} else {
+		storageUp.Set(0)
+	}
+}
+
+// Available reports the result of the last check.
+func (h *StorageHealth) Available() bool {
+	return h.up.Load()
+}
+
+// Observe schedules a check if the storage operation failed for a reason other than a missing object.
+func (h *StorageHealth) Observe(err error) {
+	if err == nil || errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	select {
+	case h.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// RequireStorage rejects the request with 503 while the storage is down.
+func (h *StorageHealth) RequireStorage(c *gin.Context) {
+	if !h.Available() {
+		JsonErrorResponse(c, ErrStorageUnavailable)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// Store wraps the storage, so failures of its operations trigger a check.
+func (h *StorageHealth) Store() storage.ObjectStore {
+	return &observedStore{ObjectStore: h.store, health: h}
+}
+
+type observedStore struct {
+	storage.ObjectStore
+	health *StorageHealth
+}
+
+func (s *observedStore) Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, opts storage.PutOptions) (storage.ObjectInfo, error) {
+	info, err := s.ObjectStore.Put(ctx, bucket, key, r, size, opts)
+	s.health.Observe(err)
+	return info, err
+}
+
+func (s *observedStore) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, storage.ObjectInfo, error) {
+	object, info, err := s.ObjectStore.Get(ctx, bucket, key)
+	s.health.Observe(err)
+	return object, info, err
+}
+
+func (s *observedStore) Stat(ctx context.Context, bucket string, key string) (storage.ObjectInfo, error) {
+	info, err := s.ObjectStore.Stat(ctx, bucket, key)
+	s.health.Observe(err)
+	return info, err
+}
+
+func (s *observedStore) Delete(ctx context.Context, bucket string, key string) error {
+	err := s.ObjectStore.Delete(ctx, bucket, key)
+	s.health.Observe(err)
+	return err
+}
+
+func (s *observedStore) List(ctx context.Context, bucket string, prefix string) iter.Seq2[storage.ObjectInfo, error] {
+	return func(yield func(storage.ObjectInfo, error) bool) {
+		for info, err := range s.ObjectStore.List(ctx, bucket, prefix) {
+			s.health.Observe(err)
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (s *observedStore) MakeBucket(ctx context.Context, bucket config.S3Bucket) error {
+	err := s.ObjectStore.MakeBucket(ctx, bucket)
+	s.health.Observe(err)
+	return err
+}
+
+var storageUp = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "colossus_backend_storage_up",
+		Help: "Whether the object storage answered the last health check",
+	},
+)
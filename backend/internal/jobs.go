@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"github.com/prometheus/client_golang/prometheus"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrJobNotFound = errs.New(errs.NotFound, "job not found")
+
+type Job struct {
+	Id                string               `json:"id"`
+	Status            tasks.JobStatus      `json:"status"`
+	FilenameRaw       string               `json:"filename_raw"`
+	FilenameProcessed string               `json:"filename_processed"`
+	Variants          []JobVariant         `json:"variants,omitempty"`
+	Error             string               `json:"error,omitempty"`
+	CreatedAt         time.Time            `json:"created_at"`
+	UpdatedAt         time.Time            `json:"updated_at"`
+	StartedAt         *time.Time           `json:"started_at,omitempty"`
+	FinishedAt        *time.Time           `json:"finished_at,omitempty"`
+	Result            *tasks.ConvertResult `json:"result,omitempty"`
+	// Task is kept to requeue it if it gets lost
+	Task *tasks.ConvertTask `json:"task,omitempty"`
+}
+
+// JobVariant names a rendition requested by the job.
+type JobVariant struct {
+	Name              string `json:"name"`
+	FilenameProcessed string `json:"filename_processed"`
+}
+
+type JobStore interface {
+	Create(ctx context.Context, job *Job) error
+	Get(ctx context.Context, id string) (*Job, error)
+	Update(ctx context.Context, id string, fn func(job *Job) error) error
+}
+
+func NewJobStore(cfg *utils.Config, store storage.ObjectStore) (JobStore, error) {
+	switch cfg.Jobs.Store {
+	case "memory":
+		return NewMemoryJobStore(), nil
+	case "s3", "":
+		// Jobs are kept in the object storage, whatever driver it uses
+		return NewObjectJobStore(store, cfg.S3.Buckets.Jobs.Name), nil
+	default:
+		return nil, fmt.Errorf("unknown job store %q", cfg.Jobs.Store)
+	}
+}
+
+// MemoryJobStore keeps jobs in process memory. Useful for tests and local runs.
+type MemoryJobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]Job
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[string]Job)}
+}
+
+func (s *MemoryJobStore) Create(_ context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.Id] = *job
+	return nil
+}
+
+func (s *MemoryJobStore) Get(_ context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (s *MemoryJobStore) Update(_ context.Context, id string, fn func(job *Job) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if err := fn(&job); err != nil {
+		return err
+	}
+	s.jobs[id] = job
+	return nil
+}
+
+// jobLockStripes is the number of locks updates of jobs are spread over.
+const jobLockStripes = 64
+
+// ObjectJobStore persists every job as a JSON object in the jobs bucket.
+// A single backend updates the jobs, so updates are serialized in process.
+type ObjectJobStore struct {
+	store  storage.ObjectStore
+	bucket string
+	// locks serialize updates of a job, its object is read, changed and written back
+	locks [jobLockStripes]sync.Mutex
+}
+
+func NewObjectJobStore(store storage.ObjectStore, bucket string) *ObjectJobStore {
+	return &ObjectJobStore{store: store, bucket: bucket}
+}
+
+func (s *ObjectJobStore) objectName(id string) string {
+	return id + ".json"
+}
+
+func (s *ObjectJobStore) Create(ctx context.Context, job *Job) error {
+	return s.put(ctx, job)
+}
+
+func (s *ObjectJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	object, _, err := s.store.Get(ctx, s.bucket, s.objectName(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var job Job
+	err = json.NewDecoder(object).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *ObjectJobStore) Update(ctx context.Context, id string, fn func(job *Job) error) error {
+	lock := s.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	job, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err = fn(job); err != nil {
+		return err
+	}
+	return s.put(ctx, job)
+}
+
+func (s *ObjectJobStore) lock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return &s.locks[h.Sum32()%jobLockStripes]
+}
+
+func (s *ObjectJobStore) put(ctx context.Context, job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.store.Put(
+		ctx, s.bucket, s.objectName(job.Id), bytes.NewReader(b),
+		int64(len(b)), storage.PutOptions{ContentType: "application/json"},
+	)
+	return err
+}
+
+// jobEventApplies reports whether the event moves the job forward. Events are ordered by their
+// statuses rather than by timestamps, which come from the clocks of other hosts, so redelivered
+// messages can not roll a finished job back.
+func jobEventApplies(job *Job, event *tasks.JobStatusEvent) bool {
+	switch event.Status {
+	case tasks.JobStatusQueued:
+		// A new run of the task, e.g. requeued by the reconciler
+		return true
+	case tasks.JobStatusProcessing:
+		switch job.Status {
+		case tasks.JobStatusDone:
+			return false
+		case tasks.JobStatusFailed:
+			// A replay from the dead-letter topic starts after the failure, the failed run started before it.
+			// Both times come from the converter.
+			return job.FinishedAt == nil || event.Timestamp.After(*job.FinishedAt)
+		}
+		return true
+	case tasks.JobStatusFailed:
+		return job.Status != tasks.JobStatusDone
+	case tasks.JobStatusDone:
+		return true
+	}
+	return false
+}
+
+// ApplyJobStatusEvent moves the job to the state described by the event, unless the job is past it.
+func ApplyJobStatusEvent(ctx context.Context, store JobStore, event *tasks.JobStatusEvent) error {
+	return store.Update(ctx, event.JobId, func(job *Job) error {
+		if !jobEventApplies(job, event) {
+			return nil
+		}
+		ts := event.Timestamp
+		job.Status = event.Status
+		job.UpdatedAt = time.Now().UTC()
+		switch event.Status {
+		case tasks.JobStatusQueued:
+			job.StartedAt = nil
+			job.FinishedAt = nil
+			job.Error = ""
+		case tasks.JobStatusProcessing:
+			job.StartedAt = &ts
+			job.FinishedAt = nil
+			job.Error = ""
+		case tasks.JobStatusDone:
+			job.FinishedAt = &ts
+			job.Error = ""
+		case tasks.JobStatusFailed:
+			job.FinishedAt = &ts
+			job.Error = event.Error
+		}
+		return nil
+	})
+}
+
+// ApplyJobResult attaches the conversion result to the job.
+func ApplyJobResult(ctx context.Context, store JobStore, result *tasks.ConvertResult) error {
+	return store.Update(ctx, result.JobId, func(job *Job) error {
+		job.Result = result
+		return nil
+	})
+}
+
+// StartJobEventsConsumer reads status events and results from the queue and applies them to the store
+// until ctx is canceled.
+func StartJobEventsConsumer(ctx context.Context, cfg *utils.Config, store JobStore) {
+	topics := []string{cfg.Kafka.StatusTopic.Name, cfg.Kafka.ResultsTopic.Name}
+	q, err := NewQueue(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %s\n", err)
+	}
+	consumer, err := q.Consumer("", topics)
+	if err != nil {
+		log.Fatalf("Failed to create job events consumer for %v: %s\n", topics, err)
+	}
+	defer consumer.Close()
+
+	for ctx.Err() == nil {
+		msg, err := consumer.Poll(100 * time.Millisecond)
+		if err != nil {
+			log.Fatalf("Failed to consume job events: %s\n", err)
+		}
+		if msg == nil {
+			continue
+		}
+
+		if !applyJobEventMessage(ctx, cfg, store, msg) {
+			return
+		}
+		consumer.Done(msg)
+	}
+}
+
+// Bounds of the wait between attempts to apply a job event while the store is unavailable
+const (
+	jobEventsMinBackoff = 500 * time.Millisecond
+	jobEventsMaxBackoff = 30 * time.Second
+)
+
+// applyJobEventMessage applies the message. Malformed messages and events of unknown jobs are dropped.
+// It returns false if ctx is canceled before the message is applied, so it is redelivered later.
+func applyJobEventMessage(ctx context.Context, cfg *utils.Config, store JobStore, msg *queue.Message) bool {
+	backoff := jobEventsMinBackoff
+	for {
+		var err error
+		switch msg.Topic {
+		case cfg.Kafka.StatusTopic.Name:
+			err = handleJobStatusMessage(ctx, store, msg)
+		case cfg.Kafka.ResultsTopic.Name:
+			err = handleJobResultMessage(ctx, store, msg)
+		}
+		if err == nil {
+			return true
+		}
+		if errs.Permanent(err) {
+			log.Printf("Dropping job event from %s: %s\n", msg.Topic, err)
+			return true
+		}
+		log.Printf("Failed to apply job event from %s, retrying in %s: %s\n", msg.Topic, backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, jobEventsMaxBackoff)
+	}
+}
+
+func handleJobStatusMessage(ctx context.Context, store JobStore, msg *queue.Message) error {
+	event := tasks.JobStatusEvent{}
+	err := json.Unmarshal(msg.Value, &event)
+	if err != nil {
+		return errs.Wrap(errs.Validation, fmt.Errorf("deserialize status event: %w", err))
+	}
+	err = ApplyJobStatusEvent(ctx, store, &event)
+	if err != nil {
+		return fmt.Errorf("apply status event %+v: %w", event, err)
+	}
+	jobStatusEvents.WithLabelValues(string(event.Status)).Inc()
+	return nil
+}
+
+func handleJobResultMessage(ctx context.Context, store JobStore, msg *queue.Message) error {
+	result := tasks.ConvertResult{}
+	err := json.Unmarshal(msg.Value, &result)
+	if err != nil {
+		return errs.Wrap(errs.Validation, fmt.Errorf("deserialize job result: %w", err))
+	}
+	if result.JobId == "" {
+		return nil
+	}
+	err = ApplyJobResult(ctx, store, &result)
+	if err != nil {
+		return fmt.Errorf("apply job result %+v: %w", result, err)
+	}
+	return nil
+}
+
+var jobStatusEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_backend_job_status_events",
+		Help: "Count applied job status events received from converter",
+	},
+	[]string{"status"},
+)
+
+func (h *Handler) HandleJobStatus(c *gin.Context) {
+	store := h.jobs
+	id := c.Param("id")
+
+	job, err := store.Get(c.Request.Context(), id)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var jobsEpoch = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// at returns a converter time, seconds after the epoch.
+func at(seconds int) time.Time {
+	return jobsEpoch.Add(time.Duration(seconds) * time.Second)
+}
+
+func TestApplyJobStatusEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   tasks.JobStatus
+		finished int
+		event    tasks.JobStatus
+		ts       int
+		want     tasks.JobStatus
+	}{
+		{"queued starts", tasks.JobStatusQueued, 0, tasks.JobStatusProcessing, 1, tasks.JobStatusProcessing},
+		{"processing finishes", tasks.JobStatusProcessing, 0, tasks.JobStatusDone, 2, tasks.JobStatusDone},
+		{"processing fails", tasks.JobStatusProcessing, 0, tasks.JobStatusFailed, 2, tasks.JobStatusFailed},
+		{"retry starts again", tasks.JobStatusProcessing, 0, tasks.JobStatusProcessing, 3, tasks.JobStatusProcessing},
+		{"done ignores processing", tasks.JobStatusDone, 2, tasks.JobStatusProcessing, 5, tasks.JobStatusDone},
+		{"done ignores failed", tasks.JobStatusDone, 2, tasks.JobStatusFailed, 5, tasks.JobStatusDone},
+		{"done ignores done", tasks.JobStatusDone, 2, tasks.JobStatusDone, 1, tasks.JobStatusDone},
+		{"failed finishes by replay", tasks.JobStatusFailed, 2, tasks.JobStatusDone, 5, tasks.JobStatusDone},
+		{"failed fails again", tasks.JobStatusFailed, 2, tasks.JobStatusFailed, 5, tasks.JobStatusFailed},
+		{"replay starts failed", tasks.JobStatusFailed, 2, tasks.JobStatusProcessing, 5, tasks.JobStatusProcessing},
+		{"redelivered start of failed run", tasks.JobStatusFailed, 2, tasks.JobStatusProcessing, 1, tasks.JobStatusFailed},
+		{"requeued done", tasks.JobStatusDone, 2, tasks.JobStatusQueued, 0, tasks.JobStatusQueued},
+		{"requeued failed", tasks.JobStatusFailed, 2, tasks.JobStatusQueued, 0, tasks.JobStatusQueued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryJobStore()
+			job := &Job{Id: "job", Status: tt.status}
+			if tt.finished != 0 {
+				finished := at(tt.finished)
+				job.FinishedAt = &finished
+			}
+			if err := store.Create(context.Background(), job); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ApplyJobStatusEvent(context.Background(), store, &tasks.JobStatusEvent{
+				JobId: "job", Status: tt.event, Error: "boom", Timestamp: at(tt.ts),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Get(context.Background(), "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want {
+				t.Errorf("status %q, want %q", got.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyJobStatusEventSequences(t *testing.T) {
+	type event struct {
+		status tasks.JobStatus
+		ts     int
+	}
+	tests := []struct {
+		name      string
+		events    []event
+		want      tasks.JobStatus
+		wantError string
+		started   int
+		finished  int
+	}{
+		{
+			name:     "in order",
+			events:   []event{{tasks.JobStatusProcessing, 1}, {tasks.JobStatusDone, 2}},
+			want:     tasks.JobStatusDone,
+			started:  1,
+			finished: 2,
+		},
+		{
+			name:     "done overtakes processing",
+			events:   []event{{tasks.JobStatusDone, 2}, {tasks.JobStatusProcessing, 1}},
+			want:     tasks.JobStatusDone,
+			finished: 2,
+		},
+		{
+			name: "replayed from the dead-letter topic",
+			events: []event{
+				{tasks.JobStatusProcessing, 1}, {tasks.JobStatusFailed, 2},
+				{tasks.JobStatusProcessing, 10}, {tasks.JobStatusDone, 11},
+			},
+			want:     tasks.JobStatusDone,
+			started:  10,
+			finished: 11,
+		},
+		{
+			name: "replay fails again",
+			events: []event{
+				{tasks.JobStatusProcessing, 1}, {tasks.JobStatusFailed, 2},
+				{tasks.JobStatusProcessing, 10}, {tasks.JobStatusFailed, 11},
+			},
+			want:      tasks.JobStatusFailed,
+			wantError: "boom",
+			started:   10,
+			finished:  11,
+		},
+		{
+			name: "redelivered events of a finished job",
+			events: []event{
+				{tasks.JobStatusProcessing, 1}, {tasks.JobStatusDone, 2},
+				{tasks.JobStatusProcessing, 1}, {tasks.JobStatusFailed, 2},
+			},
+			want:     tasks.JobStatusDone,
+			started:  1,
+			finished: 2,
+		},
+		{
+			name: "requeued after done",
+			events: []event{
+				{tasks.JobStatusProcessing, 1}, {tasks.JobStatusDone, 2}, {tasks.JobStatusQueued, 3},
+			},
+			want: tasks.JobStatusQueued,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryJobStore()
+			if err := store.Create(context.Background(), &Job{Id: "job", Status: tasks.JobStatusQueued}); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tt.events {
+				err := ApplyJobStatusEvent(context.Background(), store, &tasks.JobStatusEvent{
+					JobId: "job", Status: e.status, Error: "boom", Timestamp: at(e.ts),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			job, err := store.Get(context.Background(), "job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status != tt.want || job.Error != tt.wantError {
+				t.Errorf("status %q with error %q, want %q with %q", job.Status, job.Error, tt.want, tt.wantError)
+			}
+			checkTime(t, "started", job.StartedAt, tt.started)
+			checkTime(t, "finished", job.FinishedAt, tt.finished)
+		})
+	}
+}
+
+func checkTime(t *testing.T, name string, got *time.Time, want int) {
+	t.Helper()
+	switch {
+	case want == 0 && got != nil:
+		t.Errorf("%s at %s, want none", name, got)
+	case want != 0 && (got == nil || !got.Equal(at(want))):
+		t.Errorf("%s at %v, want %s", name, got, at(want))
+	}
+}
+
+func TestApplyJobStatusEventUnknownJob(t *testing.T) {
+	err := ApplyJobStatusEvent(context.Background(), NewMemoryJobStore(), &tasks.JobStatusEvent{
+		JobId: "missing", Status: tasks.JobStatusDone, Timestamp: at(1),
+	})
+	if !errors.Is(err, ErrJobNotFound) || !errs.Permanent(err) {
+		t.Fatalf("got %v, want a permanent %v", err, ErrJobNotFound)
+	}
+}
+
+// slowStore widens the window between reading a job and writing it back.
+type slowStore struct {
+	storage.ObjectStore
+}
+
+func (s slowStore) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, storage.ObjectInfo, error) {
+	time.Sleep(time.Millisecond)
+	return s.ObjectStore.Get(ctx, bucket, key)
+}
+
+func TestObjectJobStoreConcurrentUpdates(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "jobs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.NewLocalStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewObjectJobStore(slowStore{objects}, "jobs")
+	if err := store.Create(context.Background(), &Job{Id: "job"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const updates = 50
+	var wg sync.WaitGroup
+	for i := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Update(context.Background(), "job", func(job *Job) error {
+				job.Variants = append(job.Variants, JobVariant{Name: fmt.Sprint(i)})
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	job, err := store.Get(context.Background(), "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.Variants) != updates {
+		t.Fatalf("%d updates kept, want %d", len(job.Variants), updates)
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ImageMetadata describes an uploaded image. It is extracted once at upload and kept next to the raw image.
+// Width and Height are the dimensions of the upright image, i.e. after applying Orientation.
+type ImageMetadata struct {
+	Id          string          `json:"id"`
+	Format      string          `json:"format"`
+	ContentType string          `json:"content_type"`
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Orientation int             `json:"orientation"`
+	ColorModel  string          `json:"color_model"`
+	Size        int64           `json:"size"`
+	SHA256      string          `json:"sha256"`
+	Camera      *CameraMetadata `json:"camera,omitempty"`
+	UploadedAt  time.Time       `json:"uploaded_at"`
+}
+
+// CameraMetadata holds the EXIF fields describing how the picture was taken.
+type CameraMetadata struct {
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	Lens  string `json:"lens,omitempty"`
+	// TakenAt is the local time of the camera, EXIF does not record the time zone
+	TakenAt string `json:"taken_at,omitempty"`
+}
+
+// MetadataObjectName returns the name of the metadata of the image in the raw bucket.
+func MetadataObjectName(id string) string {
+	return fmt.Sprintf("%s-metadata.json", id)
+}
+
+// ExtractMetadata reads the whole uploaded image, which is expected to be of the detected format.
+func ExtractMetadata(id string, file io.Reader, format *imaging.ImageFormat) (*ImageMetadata, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errs.Wrap(errs.UnsupportedMedia, err)
+	}
+	exif, err := imaging.ReadExif(data, format)
+	if err != nil {
+		log.Printf("Failed to read EXIF of %s: %s\n", id, err)
+	}
+
+	hash := sha256.Sum256(data)
+	metadata := &ImageMetadata{
+		Id:          id,
+		Format:      format.Name,
+		ContentType: format.MimeType,
+		Width:       config.Width,
+		Height:      config.Height,
+		Orientation: exif.Orientation(),
+		ColorModel:  imaging.ColorModelName(config.ColorModel),
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(hash[:]),
+		UploadedAt:  time.Now().UTC(),
+	}
+	if metadata.Orientation >= 5 {
+		metadata.Width, metadata.Height = metadata.Height, metadata.Width
+	}
+
+	camera := CameraMetadata{
+		Make:    exif.Text("Make"),
+		Model:   exif.Text("Model"),
+		Lens:    exif.Text("LensModel"),
+		TakenAt: exifTime(exif.Text("DateTimeOriginal")),
+	}
+	if camera.TakenAt == "" {
+		camera.TakenAt = exifTime(exif.Text("DateTime"))
+	}
+	if camera != (CameraMetadata{}) {
+		metadata.Camera = &camera
+	}
+	return metadata, nil
+}
+
+// exifTime converts the EXIF "2006:01:02 15:04:05" format to ISO 8601, an invalid value is dropped.
+func exifTime(value string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+func StoreMetadata(ctx context.Context, store storage.ObjectStore, bucketName string, metadata *ImageMetadata) error {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(
+		ctx, bucketName, MetadataObjectName(metadata.Id), bytes.NewReader(b),
+		int64(len(b)), storage.PutOptions{ContentType: "application/json"},
+	)
+	return err
+}
+
+func GetMetadata(ctx context.Context, store storage.ObjectStore, cfg *utils.Config, id string) (*ImageMetadata, error) {
+	object, _, err := store.Get(ctx, cfg.S3.Buckets.Raw.Name, MetadataObjectName(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var metadata ImageMetadata
+	err = json.NewDecoder(object).Decode(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func (h *Handler) HandleImageMetadata(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		JsonErrorResponse(c, errs.Errorf(errs.Validation, "invalid image id %q", id))
+		return
+	}
+
+	metadata, err := GetMetadata(c.Request.Context(), h.store, h.cfg, id)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+	cacheForever(c)
+	c.JSON(http.StatusOK, metadata)
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	outboxBucket = []byte("messages")
+	// outboxQuarantineBucket keeps entries which can not be decoded, they are never published
+	outboxQuarantineBucket = []byte("quarantine")
+)
+
+// outboxAckTimeout bounds waiting for the broker to acknowledge a batch.
+const outboxAckTimeout = 30 * time.Second
+
+// Outbox keeps messages on disk until they are published. A message recorded in the outbox
+// is published eventually, even if the broker is down or the backend restarts in between.
+// Messages are published in order of addition, at least once; a message which failed to
+// publish may be overtaken by the ones published together with it.
+type Outbox struct {
+	db        *bbolt.DB
+	publisher queue.AsyncPublisher
+	// delivered is told the result of every publish attempt
+	delivered func(msg *queue.Message, publishedAt time.Time, err error)
+	retryWait time.Duration
+	batchSize int
+	notify    chan struct{}
+}
+
+type outboxEntry struct {
+	Topic     string    `json:"topic"`
+	Key       []byte    `json:"key,omitempty"`
+	Value     []byte    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// outboxMessage is a message of a batch being relayed.
+type outboxMessage struct {
+	key         []byte
+	msg         *queue.Message
+	publishedAt time.Time
+	delivery    *queue.Delivery
+}
+
+// OpenOutbox opens the outbox file, messages left unpublished by a previous run are kept.
+func OpenOutbox(cfg utils.Outbox, publisher queue.AsyncPublisher, delivered func(msg *queue.Message, publishedAt time.Time, err error)) (*Outbox, error) {
+	path := cfg.Path
+	if path == "" {
+		path = "outbox.db"
+	}
+	retryWait := time.Duration(cfg.RetryIntervalMs) * time.Millisecond
+	if retryWait <= 0 {
+		retryWait = 2 * time.Second
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(outboxBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(outboxQuarantineBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	o := &Outbox{
+		db:        db,
+		publisher: publisher,
+		delivered: delivered,
+		retryWait: retryWait,
+		batchSize: batchSize,
+		notify:    make(chan struct{}, 1),
+	}
+	pending := o.Pending()
+	outboxPending.Set(float64(pending))
+	if pending > 0 {
+		log.Printf("Outbox has %d unpublished messages\n", pending)
+	}
+	return o, nil
+}
+
+// Add records the message. It returns once the message is synced to disk.
+func (o *Outbox) Add(msg *queue.Message) error {
+	b, err := json.Marshal(outboxEntry{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = o.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(outboxKey(seq), b)
+	})
+	if err != nil {
+		return err
+	}
+	outboxPending.Inc()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of unpublished messages.
+func (o *Outbox) Pending() int {
+	var n int
+	_ = o.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(outboxBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// PendingKeys returns the keys of unpublished messages.
+func (o *Outbox) PendingKeys() (map[string]bool, error) {
+	keys := map[string]bool{}
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				// Quarantined by the relay
+				return nil
+			}
+			keys[string(entry.Key)] = true
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Run publishes recorded messages until ctx is canceled. After a failure the outbox
+// waits before it retries, so a broker outage does not turn into a busy loop.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.retryWait)
+	defer ticker.Stop()
+
+	for {
+		if err := o.relay(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to relay outbox: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay publishes messages in batches until none is left. It stops after a batch
+// in which a message failed to publish.
+func (o *Outbox) relay(ctx context.Context) error {
+	for ctx.Err() == nil {
+		batch, err := o.next(o.batchSize)
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		if err := o.publishBatch(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// publishBatch publishes the whole batch without waiting, then deletes messages as their
+// acknowledgements arrive. It returns the first failure.
+func (o *Outbox) publishBatch(ctx context.Context, batch []*outboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxAckTimeout)
+	defer cancel()
+
+	var failure error
+	var published []*outboxMessage
+	for _, m := range batch {
+		m.publishedAt = time.Now()
+		d, err := o.publisher.PublishAsync(m.msg)
+		if err != nil {
+			o.delivered(m.msg, m.publishedAt, err)
+			outboxRelayed.WithLabelValues("error").Inc()
+			failure = err
+			break
+		}
+		m.delivery = d
+		published = append(published, m)
+	}
+
+	var acknowledged [][]byte
+	for _, m := range published {
+		select {
+		case <-m.delivery.Done():
+		case <-ctx.Done():
+			// Unacknowledged messages stay in the outbox and are published again
+			if failure == nil {
+				failure = errs.Wrap(errs.QueueUnavailable, ctx.Err())
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		err := m.delivery.Err()
+		o.delivered(m.msg, m.publishedAt, err)
+		if err != nil {
+			outboxRelayed.WithLabelValues("error").Inc()
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		outboxRelayed.WithLabelValues("ok").Inc()
+		acknowledged = append(acknowledged, m.key)
+	}
+
+	// If the backend stops right here, the messages are published again after restart
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		for _, key := range acknowledged {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	outboxPending.Sub(float64(len(acknowledged)))
+	return failure
+}
+
+// next returns up to n oldest messages. Entries which can not be decoded would block the relay
+// forever, they are moved to the quarantine bucket instead.
+func (o *Outbox) next(n int) ([]*outboxMessage, error) {
+	for {
+		var batch []*outboxMessage
+		undecodable := map[string][]byte{}
+		err := o.db.View(func(tx *bbolt.Tx) error {
+			c := tx.Bucket(outboxBucket).Cursor()
+			for k, v := c.First(); k != nil && len(batch) < n; k, v = c.Next() {
+				// Keys and values are only valid inside the transaction
+				key := append([]byte(nil), k...)
+				var entry outboxEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					log.Printf("Failed to decode outbox entry %x, quarantining it: %s\n", key, err)
+					undecodable[string(key)] = append([]byte(nil), v...)
+					continue
+				}
+				batch = append(batch, &outboxMessage{
+					key: key,
+					msg: &queue.Message{Topic: entry.Topic, Key: entry.Key, Value: entry.Value},
+				})
+			}
+			return nil
+		})
+		if err != nil || len(undecodable) == 0 {
+			return batch, err
+		}
+
+		err = o.db.Update(func(tx *bbolt.Tx) error {
+			for key, value := range undecodable {
+				if err := tx.Bucket(outboxQuarantineBucket).Put([]byte(key), value); err != nil {
+					return err
+				}
+				if err := tx.Bucket(outboxBucket).Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		outboxPending.Sub(float64(len(undecodable)))
+		outboxRelayed.WithLabelValues("quarantined").Add(float64(len(undecodable)))
+		if len(batch) > 0 {
+			return batch, nil
+		}
+	}
+}
+
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// outboxKey encodes the sequence in big endian, so keys are iterated in order of addition.
+func outboxKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+var outboxPending = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "colossus_backend_outbox_pending",
+		Help: "Number of messages recorded in the outbox and not published yet",
+	},
+)
+
+var outboxRelayed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_backend_outbox_relayed",
+		Help: "Count publish attempts of outbox messages by result: ok, error or quarantined",
+	},
+	[]string{"result"},
+)
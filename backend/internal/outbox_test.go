@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+const outboxTestTopic = "tasks"
+
+// testOutbox opens the outbox at path, publishing to the broker and recording failed deliveries.
+func testOutbox(t *testing.T, path string, broker *queue.MemoryBroker, batchSize int) (*Outbox, *[]error) {
+	t.Helper()
+	var failures []error
+	o, err := OpenOutbox(utils.Outbox{Path: path, BatchSize: batchSize}, broker.Publisher(), func(_ *queue.Message, _ time.Time, err error) {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, &failures
+}
+
+func addMessages(t *testing.T, o *Outbox, values ...string) {
+	t.Helper()
+	for _, value := range values {
+		if err := o.Add(&queue.Message{Topic: outboxTestTopic, Key: []byte("key-" + value), Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fillTopic fills the topic, leaving room for the given number of messages.
+func fillTopic(t *testing.T, broker *queue.MemoryBroker, free int) {
+	t.Helper()
+	publisher := broker.Publisher()
+	for {
+		if _, err := publisher.PublishAsync(&queue.Message{Topic: outboxTestTopic, Value: []byte("filler")}); err != nil {
+			break
+		}
+	}
+	consumer := broker.Consumer([]string{outboxTestTopic})
+	for range free {
+		if msg, _ := consumer.Poll(time.Second); msg == nil {
+			t.Fatal("no filler message to consume")
+		}
+	}
+}
+
+// consume returns the values of all messages published so far, fillers excluded.
+func consume(t *testing.T, broker *queue.MemoryBroker) []string {
+	t.Helper()
+	consumer := broker.Consumer([]string{outboxTestTopic})
+	var values []string
+	for {
+		msg, err := consumer.Poll(10 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			return values
+		}
+		consumer.Done(msg)
+		if string(msg.Value) != "filler" {
+			values = append(values, string(msg.Value))
+		}
+	}
+}
+
+func TestOutboxRelaysInBatches(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	o, failures := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"), broker, 2)
+	defer o.Close()
+
+	addMessages(t, o, "a", "b", "c", "d", "e")
+	if err := o.relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := consume(t, broker); !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("published %q", got)
+	}
+	if o.Pending() != 0 || len(*failures) != 0 {
+		t.Errorf("%d messages pending, failures %v", o.Pending(), *failures)
+	}
+}
+
+func TestOutboxPartialBatchFailure(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	o, failures := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"), broker, 10)
+	defer o.Close()
+
+	// Only three messages of the batch fit into the topic
+	fillTopic(t, broker, 3)
+	addMessages(t, o, "a", "b", "c", "d", "e")
+	if err := o.relay(context.Background()); err == nil {
+		t.Fatal("relaying to a full topic succeeded")
+	}
+	if o.Pending() != 2 || len(*failures) != 1 {
+		t.Fatalf("%d messages pending and %d failures, want 2 and 1", o.Pending(), len(*failures))
+	}
+	keys, err := o.PendingKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !keys["key-d"] || !keys["key-e"] {
+		t.Errorf("pending keys %v, want those of d and e", keys)
+	}
+
+	got := consume(t, broker)
+	if err := o.relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, consume(t, broker)...)
+	if !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("published %q", got)
+	}
+	if o.Pending() != 0 {
+		t.Errorf("%d messages pending", o.Pending())
+	}
+}
+
+func TestOutboxQuarantinesUndecodableEntries(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	o, _ := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"), broker, 10)
+	defer o.Close()
+
+	addMessages(t, o, "a", "b", "c")
+	corrupt := outboxKey(2)
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(outboxBucket).Put(corrupt, []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := consume(t, broker); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("published %q", got)
+	}
+	if o.Pending() != 0 {
+		t.Errorf("%d messages pending", o.Pending())
+	}
+	err = o.db.View(func(tx *bbolt.Tx) error {
+		quarantined := tx.Bucket(outboxQuarantineBucket)
+		if n := quarantined.Stats().KeyN; n != 1 {
+			return fmt.Errorf("%d entries quarantined, want 1", n)
+		}
+		if value := quarantined.Get(corrupt); string(value) != "{not json" {
+			return fmt.Errorf("quarantined %q", value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutboxOrderAfterRestart(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	path := filepath.Join(t.TempDir(), "outbox.db")
+
+	o, _ := testOutbox(t, path, broker, 2)
+	fillTopic(t, broker, 1)
+	addMessages(t, o, "a", "b", "c")
+	if err := o.relay(context.Background()); err == nil {
+		t.Fatal("relaying to a full topic succeeded")
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpublished messages are kept and go before the ones added after restart
+	o, _ = testOutbox(t, path, broker, 2)
+	defer o.Close()
+	if o.Pending() != 2 {
+		t.Fatalf("%d messages pending after restart, want 2", o.Pending())
+	}
+	got := consume(t, broker)
+	addMessages(t, o, "d", "e")
+	if err := o.relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, consume(t, broker)...)
+	if !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("published %q", got)
+	}
+}
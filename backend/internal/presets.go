@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"net/http"
+)
+
+// ConversionOptions are the options of a single rendition sent to the converter.
+type ConversionOptions struct {
+	Resize *imaging.ResizeSpec
+	Filter string
+	Output *imaging.OutputSpec
+}
+
+// NewConversionOptions validates the preset and converts it to the converter's options.
+func NewConversionOptions(preset *config.Preset) (*ConversionOptions, error) {
+	options := ConversionOptions{Filter: preset.Filter}
+	if preset.Filter != "" && !isKnownFilter(preset.Filter) {
+		return nil, fmt.Errorf("unknown filter %q", preset.Filter)
+	}
+
+	if preset.Width != 0 || preset.Height != 0 || preset.Mode != "" {
+		options.Resize = &imaging.ResizeSpec{
+			Width:      preset.Width,
+			Height:     preset.Height,
+			Mode:       imaging.ResizeMode(preset.Mode),
+			Background: preset.Background,
+			Upscale:    preset.Upscale,
+		}
+		if options.Resize.Mode == "" {
+			options.Resize.Mode = imaging.ResizeModeFit
+		}
+		if err := options.Resize.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if preset.Format != "" || preset.Poster {
+		options.Output = &imaging.OutputSpec{
+			Format:      preset.Format,
+			Quality:     preset.Quality,
+			Compression: preset.Compression,
+			Poster:      preset.Poster,
+		}
+	}
+	if preset.Format != "" {
+		if err := options.Output.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &options, nil
+}
+
+// LookupPreset returns the preset by name.
+func LookupPreset(cfg *utils.Config, name string) (*config.Preset, error) {
+	preset, ok := cfg.Presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+	return &preset, nil
+}
+
+// MergePresets returns the base preset with non-zero options of the override applied on top.
+func MergePresets(base config.Preset, override config.Preset) config.Preset {
+	if override.Width != 0 {
+		base.Width = override.Width
+	}
+	if override.Height != 0 {
+		base.Height = override.Height
+	}
+	if override.Mode != "" {
+		base.Mode = override.Mode
+	}
+	if override.Background != "" {
+		base.Background = override.Background
+	}
+	if override.Upscale {
+		base.Upscale = true
+	}
+	if override.Filter != "" {
+		base.Filter = override.Filter
+	}
+	if override.Format != "" && override.Format != base.Format {
+		// Encoder options of the base format do not apply to another one
+		base.Format = override.Format
+		base.Quality = 0
+		base.Compression = ""
+	}
+	if override.Quality != 0 {
+		base.Quality = override.Quality
+	}
+	if override.Compression != "" {
+		base.Compression = override.Compression
+	}
+	if override.Poster {
+		base.Poster = true
+	}
+	return base
+}
+
+func (h *Handler) HandlePresets(c *gin.Context) {
+	cfg := h.cfg
+	c.JSON(http.StatusOK, gin.H{
+		"presets":      cfg.Presets,
+		"variant_sets": cfg.VariantSets,
+	})
+}
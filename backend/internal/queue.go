@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/queue"
+)
+
+// NewQueue returns the client of the broker selected by the config.
+func NewQueue(cfg *utils.Config) (*queue.Client, error) {
+	return queue.New(&cfg.Queue, queue.KafkaConfig{
+		BootstrapServers: cfg.Kafka.BootstrapServers,
+		ClientId:         cfg.Kafka.ClientId,
+		Acks:             cfg.Kafka.Acks,
+		GroupId:          cfg.Kafka.GroupId,
+	})
+}
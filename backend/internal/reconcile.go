@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"log"
+	"time"
+)
+
+// ReconcileOptions control a reconciliation pass. Zero values are replaced by defaults:
+// 10 minutes grace period and 10 requeued tasks per second.
+type ReconcileOptions struct {
+	// GracePeriod skips raw images uploaded recently, their tasks are likely still queued
+	GracePeriod time.Duration
+	// RatePerSecond limits requeued tasks, so a large backlog does not flood the converter
+	RatePerSecond float64
+	// DryRun only logs the tasks which would be requeued
+	DryRun bool
+}
+
+func NewReconcileOptions(cfg utils.Reconcile) ReconcileOptions {
+	return ReconcileOptions{
+		GracePeriod:   time.Duration(cfg.GracePeriodMs) * time.Millisecond,
+		RatePerSecond: cfg.RatePerSecond,
+		DryRun:        cfg.DryRun,
+	}
+}
+
+type ReconcileReport struct {
+	Checked  int `json:"checked"`
+	Missing  int `json:"missing"`
+	Requeued int `json:"requeued"`
+}
+
+// Reconciler finds raw images without processed objects and requeues their tasks,
+// which recovers uploads whose messages were lost.
+type Reconciler struct {
+	cfg     *utils.Config
+	store   storage.ObjectStore
+	jobs    JobStore
+	requeue func(ctx context.Context, msg *queue.Message) error
+	// pending returns the raw images whose tasks are requeued but not published yet, it may be nil
+	pending func() (map[string]bool, error)
+}
+
+func NewReconciler(cfg *utils.Config, store storage.ObjectStore, jobs JobStore, requeue func(ctx context.Context, msg *queue.Message) error, pending func() (map[string]bool, error)) *Reconciler {
+	return &Reconciler{cfg: cfg, store: store, jobs: jobs, requeue: requeue, pending: pending}
+}
+
+// Run reconciles every interval until ctx is canceled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, opts ReconcileOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := r.Reconcile(ctx, opts)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Reconciliation failed: %s\n", err)
+		}
+		log.Printf("Reconciliation checked %d raw images, %d missing processed objects, %d requeued\n",
+			report.Checked, report.Missing, report.Requeued)
+	}
+}
+
+// Reconcile makes a single pass over the raw bucket.
+func (r *Reconciler) Reconcile(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error) {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = 10 * time.Minute
+	}
+	if opts.RatePerSecond <= 0 {
+		opts.RatePerSecond = 10
+	}
+	limiter := rate.NewLimiter(rate.Limit(opts.RatePerSecond), 1)
+	uploadedBefore := time.Now().Add(-opts.GracePeriod)
+
+	// Tasks waiting in the outbox, e.g. during a broker outage, are not requeued again
+	pending := map[string]bool{}
+	if r.pending != nil {
+		var err error
+		if pending, err = r.pending(); err != nil {
+			return ReconcileReport{}, err
+		}
+	}
+
+	var report ReconcileReport
+	for info, err := range r.store.List(ctx, r.cfg.S3.Buckets.Raw.Name, "") {
+		if err != nil {
+			return report, err
+		}
+		id, ext, ok := ParseRawObjectName(info.Key)
+		if !ok || info.LastModified.After(uploadedBefore) {
+			continue
+		}
+		report.Checked++
+		if pending[info.Key] {
+			reconciledImages.WithLabelValues("pending").Inc()
+			continue
+		}
+
+		task, err := r.missingTask(ctx, id, ext, info.Key)
+		if err != nil {
+			return report, err
+		}
+		if task == nil {
+			continue
+		}
+		report.Missing++
+		reconciledImages.WithLabelValues("missing").Inc()
+
+		if opts.DryRun {
+			log.Printf("Would requeue %s\n", info.Key)
+			continue
+		}
+		if err = limiter.Wait(ctx); err != nil {
+			return report, err
+		}
+		if err = r.requeueTask(ctx, task); err != nil {
+			return report, err
+		}
+		report.Requeued++
+		reconciledImages.WithLabelValues("requeued").Inc()
+		log.Printf("Requeued %s\n", info.Key)
+	}
+	return report, nil
+}
+
+// missingTask returns the task to requeue if processed objects of the raw image are missing.
+// The task is restored from the job. Without a job, the image is processed with default options
+// unless any object with its processed prefix exists.
+func (r *Reconciler) missingTask(ctx context.Context, id string, ext string, rawName string) (*tasks.ConvertTask, error) {
+	processedBucket := r.cfg.S3.Buckets.Processed.Name
+
+	job, err := r.jobs.Get(ctx, id)
+	if errors.Is(err, ErrJobNotFound) {
+		for _, err := range r.store.List(ctx, processedBucket, ProcessedObjectName(id, "")) {
+			if err != nil {
+				return nil, err
+			}
+			return nil, nil
+		}
+		// Status events of a task without a job are not emitted
+		return &tasks.ConvertTask{
+			FilenameRaw:       rawName,
+			FilenameProcessed: ProcessedObjectName(id, ext),
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Tasks failed by the converter are in the dead-letter topic, they are replayed by the converter.
+	// A failed job that never started was not queued at all, e.g. the outbox was unavailable.
+	if job.Status == tasks.JobStatusFailed && (job.StartedAt != nil || job.Result != nil) {
+		return nil, nil
+	}
+
+	task := job.Task
+	if task == nil {
+		// Jobs created before tasks were kept in them
+		task = &tasks.ConvertTask{JobId: job.Id, FilenameRaw: job.FilenameRaw, FilenameProcessed: job.FilenameProcessed}
+	}
+	for _, variant := range task.AllVariants() {
+		_, err := r.store.Stat(ctx, processedBucket, variant.FilenameProcessed)
+		if errors.Is(err, storage.ErrNotFound) {
+			return task, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// requeueTask marks the job queued before publishing the task. Marked afterwards, a fast converter
+// could have the job processing or done already, and queued would take it back.
+func (r *Reconciler) requeueTask(ctx context.Context, task *tasks.ConvertTask) error {
+	requeued := *task
+	requeued.Message = "requeued by reconciler"
+	requeued.QueuedAt = time.Now().UTC()
+
+	msg, err := NewTaskMessage(r.cfg, &requeued)
+	if err != nil {
+		return err
+	}
+
+	if requeued.JobId != "" {
+		err = ApplyJobStatusEvent(ctx, r.jobs, &tasks.JobStatusEvent{
+			JobId:     requeued.JobId,
+			Status:    tasks.JobStatusQueued,
+			Timestamp: requeued.QueuedAt,
+		})
+		if err != nil {
+			log.Printf("Failed to mark job %s queued: %s\n", requeued.JobId, err)
+		}
+	}
+	return r.requeue(ctx, msg)
+}
+
+var reconciledImages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_backend_reconciled_images",
+		Help: "Count raw images found without processed objects, requeued ones and ones whose tasks are still in the outbox",
+	},
+	[]string{"result"},
+)
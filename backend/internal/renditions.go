@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+var (
+	ErrImageNotFound   = errs.New(errs.NotFound, "image not found")
+	ErrSizeNotAllowed  = errs.New(errs.Validation, "size is not allowed")
+	ErrUnsupportedType = errs.New(errs.UnsupportedMedia, "unsupported image type")
+)
+
+// renditionsGroup makes concurrent requests for the same rendition share a single conversion.
+var renditionsGroup singleflight.Group
+
+// RenditionRequest describes a rendition requested from GET /images/:id.
+type RenditionRequest struct {
+	Width  int
+	Height int
+	Fit    imaging.ResizeMode
+	Format string
+}
+
+// Rendition is a converted image ready to be served.
+type Rendition struct {
+	Data        []byte
+	ContentType string
+}
+
+// ParseRenditionRequest reads the query of GET /images/:id. Only the sizes listed in the config
+// are accepted, so clients can not fill the renditions bucket with arbitrary sizes.
+func ParseRenditionRequest(c *gin.Context, cfg *utils.Config) (*RenditionRequest, error) {
+	var req RenditionRequest
+	var err error
+
+	if value := c.Query("w"); value != "" {
+		if req.Width, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid w %q", value)
+		}
+	}
+	if value := c.Query("h"); value != "" {
+		if req.Height, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid h %q", value)
+		}
+	}
+	if !slices.Contains(cfg.Renditions.Sizes, fmt.Sprintf("%dx%d", req.Width, req.Height)) {
+		return nil, fmt.Errorf("%w: %dx%d, allowed sizes are %v", ErrSizeNotAllowed, req.Width, req.Height, cfg.Renditions.Sizes)
+	}
+
+	req.Fit = imaging.ResizeMode(c.DefaultQuery("fit", string(imaging.ResizeModeFit)))
+	if err = req.resizeSpec().Validate(); err != nil {
+		return nil, err
+	}
+
+	req.Format = c.Query("format")
+	if req.Format != "" {
+		if _, err = imaging.FormatByName(req.Format); err != nil {
+			return nil, err
+		}
+	}
+	return &req, nil
+}
+
+func (r *RenditionRequest) resizeSpec() *imaging.ResizeSpec {
+	return &imaging.ResizeSpec{Width: r.Width, Height: r.Height, Mode: r.Fit}
+}
+
+// objectName returns the name of the rendition in the renditions bucket.
+// Renditions in the format of the upload are stored under the "original" suffix.
+func (r *RenditionRequest) objectName(id string) string {
+	format := r.Format
+	if format == "" {
+		format = "original"
+	}
+	return fmt.Sprintf("%s/%dx%d-%s-%s", id, r.Width, r.Height, r.Fit, format)
+}
+
+// GetRendition returns the rendition of the image, converting and storing it when it is missing.
+func GetRendition(ctx context.Context, store storage.ObjectStore, cfg *utils.Config, id string, req *RenditionRequest) (*Rendition, error) {
+	objectName := req.objectName(id)
+	bucketName := cfg.S3.Buckets.Renditions.Name
+	object, info, err := store.Get(ctx, bucketName, objectName)
+	if err == nil {
+		defer object.Close()
+		data, err := io.ReadAll(object)
+		if err != nil {
+			return nil, err
+		}
+		renditionRequests.WithLabelValues("hit").Inc()
+		return &Rendition{Data: data, ContentType: info.ContentType}, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	// The conversion is shared by all waiting requests, so it must not be canceled with one of them.
+	v, err, shared := renditionsGroup.Do(bucketName+"/"+objectName, func() (interface{}, error) {
+		return generateRendition(context.WithoutCancel(ctx), store, cfg, id, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		renditionRequests.WithLabelValues("shared").Inc()
+	} else {
+		renditionRequests.WithLabelValues("generated").Inc()
+	}
+	return v.(*Rendition), nil
+}
+
+func generateRendition(ctx context.Context, store storage.ObjectStore, cfg *utils.Config, id string, req *RenditionRequest) (*Rendition, error) {
+	rawBucket := cfg.S3.Buckets.Raw.Name
+	var rawName string
+	for info, err := range store.List(ctx, rawBucket, id+"-raw") {
+		if err != nil {
+			return nil, err
+		}
+		rawName = info.Key
+		break
+	}
+	if rawName == "" {
+		return nil, ErrImageNotFound
+	}
+
+	object, info, err := store.Get(ctx, rawBucket, rawName)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	raw, err := io.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	inFormat, err := imaging.FormatByMimeType(info.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, err)
+	}
+	var output *imaging.OutputSpec
+	if req.Format != "" {
+		output = &imaging.OutputSpec{Format: req.Format}
+	}
+	outFormat, err := imaging.OutputFormat(inFormat, output)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := imaging.GetFilter(cfg.Renditions.Filter, imaging.DefaultFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := inFormat.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, err)
+	}
+	exif, err := imaging.ReadExif(raw, inFormat)
+	if err != nil {
+		log.Printf("Failed to read EXIF of %s: %s\n", rawName, err)
+	}
+	src = imaging.Orient(src, exif.Orientation())
+	var buf bytes.Buffer
+	rect, err := imaging.Convert(src, &buf, outFormat, imaging.Options{
+		Resize: req.resizeSpec(),
+		Filter: filter,
+		Output: output,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objectName := req.objectName(id)
+	_, err = store.Put(
+		ctx, cfg.S3.Buckets.Renditions.Name, objectName, bytes.NewReader(buf.Bytes()), int64(buf.Len()),
+		storage.PutOptions{
+			ContentType: outFormat.MimeType,
+			Metadata: map[string]string{
+				storage.MetadataWidth:  strconv.Itoa(rect.Dx()),
+				storage.MetadataHeight: strconv.Itoa(rect.Dy()),
+			},
+		},
+	)
+	if err != nil {
+		// The rendition is still served, it will be converted again next time.
+		log.Printf("Failed to store rendition %s: %s\n", objectName, err)
+	}
+	return &Rendition{Data: buf.Bytes(), ContentType: outFormat.MimeType}, nil
+}
+
+var renditionRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_backend_rendition_requests",
+		Help: "Count served renditions by the way they were obtained: hit, generated or shared",
+	},
+	[]string{"result"},
+)
+
+func (h *Handler) HandleImageRendition(c *gin.Context) {
+	cfg := h.cfg
+	id := c.Param("id")
+
+	if _, err := uuid.Parse(id); err != nil {
+		JsonErrorResponse(c, errs.Errorf(errs.Validation, "invalid image id %q", id))
+		return
+	}
+	req, err := ParseRenditionRequest(c, cfg)
+	if err != nil {
+		JsonErrorResponse(c, errs.Wrap(errs.Validation, err))
+		return
+	}
+
+	rendition, err := GetRendition(c.Request.Context(), h.store, cfg, id, req)
+	if err != nil {
+		JsonErrorResponse(c, err)
+		return
+	}
+
+	cacheForever(c)
+	c.Data(http.StatusOK, rendition.ContentType, rendition.Data)
+}
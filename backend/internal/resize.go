@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"slices"
+	"strconv"
+)
+
+// ParseFilter reads the filter form field. An empty value leaves the converter's default.
+func ParseFilter(c *gin.Context) (string, error) {
+	filter := c.PostForm("filter")
+	if filter == "" || isKnownFilter(filter) {
+		return filter, nil
+	}
+	return "", fmt.Errorf("unknown filter %q, expected one of %v", filter, imaging.Filters)
+}
+
+func isKnownFilter(filter string) bool {
+	return slices.Contains(imaging.Filters, filter)
+}
+
+// ParseResizeSpec reads the resize form fields of the request.
+// It returns nil if none of them is set, leaving the converter's default.
+func ParseResizeSpec(c *gin.Context) (*imaging.ResizeSpec, error) {
+	width, hasWidth := c.GetPostForm("width")
+	height, hasHeight := c.GetPostForm("height")
+	mode, hasMode := c.GetPostForm("mode")
+	if !hasWidth && !hasHeight && !hasMode {
+		return nil, nil
+	}
+
+	spec := imaging.ResizeSpec{
+		Mode:       imaging.ResizeMode(mode),
+		Background: c.PostForm("background"),
+	}
+	if spec.Mode == "" {
+		spec.Mode = imaging.ResizeModeFit
+	}
+
+	var err error
+	if hasWidth && width != "" {
+		spec.Width, err = strconv.Atoi(width)
+		if err != nil {
+			return nil, fmt.Errorf("invalid width %q", width)
+		}
+	}
+	if hasHeight && height != "" {
+		spec.Height, err = strconv.Atoi(height)
+		if err != nil {
+			return nil, fmt.Errorf("invalid height %q", height)
+		}
+	}
+	if upscale := c.PostForm("upscale"); upscale != "" {
+		spec.Upscale, err = strconv.ParseBool(upscale)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upscale %q", upscale)
+		}
+	}
+
+	err = spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
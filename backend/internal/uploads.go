@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// multipartOverhead is allowed on top of Uploads.MaxBytes for form fields and boundaries.
+const multipartOverhead = 1 << 20
+
+// LimitUploadBody stops reading the request once it is larger than the allowed upload.
+func LimitUploadBody(w http.ResponseWriter, r *http.Request, cfg *utils.Uploads) {
+	if cfg.MaxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes+multipartOverhead)
+	}
+}
+
+// FormFileError classifies the error of reading the uploaded file from the form.
+func FormFileError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errs.Errorf(errs.TooLarge, "request is larger than %d bytes", maxBytesErr.Limit)
+	}
+	return errs.Wrap(errs.Validation, err)
+}
+
+// InspectUpload detects the format of the uploaded image by its content, not by what the client declared,
+// and checks it against the limits. A declared Content-Type or extension of another known format is rejected.
+func InspectUpload(cfg *utils.Uploads, file io.Reader, header *multipart.FileHeader) (*imaging.ImageFormat, error) {
+	if cfg.MaxBytes > 0 && header.Size > cfg.MaxBytes {
+		return nil, errs.Errorf(errs.TooLarge, "file is larger than %d bytes", cfg.MaxBytes)
+	}
+
+	format, config, err := imaging.DetectFormat(file)
+	if err != nil {
+		return nil, err
+	}
+	if allowed := allowedFormats(cfg); allowed != nil && !slices.Contains(allowed, format.Name) {
+		return nil, errs.Errorf(errs.UnsupportedMedia, "format %q is not allowed, expected one of %v", format.Name, allowed)
+	}
+	if (cfg.MaxWidth > 0 && config.Width > cfg.MaxWidth) || (cfg.MaxHeight > 0 && config.Height > cfg.MaxHeight) {
+		return nil, errs.Errorf(errs.TooLarge, "image is %dx%d, at most %dx%d is allowed", config.Width, config.Height, cfg.MaxWidth, cfg.MaxHeight)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); cfg.MaxPixels > 0 && pixels > cfg.MaxPixels {
+		return nil, errs.Errorf(errs.TooLarge, "image has %d pixels, at most %d are allowed", pixels, cfg.MaxPixels)
+	}
+
+	if declared := declaredMimeType(header); declared != "" {
+		if declaredFormat, err := imaging.FormatByMimeType(declared); err == nil && declaredFormat != format {
+			return nil, errs.Errorf(errs.UnsupportedMedia, "content type %q does not match detected %q", declared, format.MimeType)
+		}
+	}
+	if ext := filepath.Ext(header.Filename); ext != "" {
+		if extFormat, err := imaging.FormatByExtension(ext); err == nil && extFormat != format {
+			return nil, errs.Errorf(errs.UnsupportedMedia, "extension %q does not match detected %q", ext, format.MimeType)
+		}
+	}
+	return format, nil
+}
+
+// UploadFileName returns the name of the uploaded file with an extension of the detected format,
+// keeping the original one if it already belongs to the format.
+func UploadFileName(filename string, format *imaging.ImageFormat) string {
+	ext := filepath.Ext(filename)
+	if extFormat, err := imaging.FormatByExtension(ext); err == nil && extFormat == format {
+		return filename
+	}
+	return strings.TrimSuffix(filename, ext) + format.Extension
+}
+
+func declaredMimeType(header *multipart.FileHeader) string {
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func allowedFormats(cfg *utils.Uploads) []string {
+	var formats []string
+	for _, name := range strings.Split(cfg.AllowedFormats, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			formats = append(formats, name)
+		}
+	}
+	return formats
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ojgenbar/Colossus/backend/utils"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"regexp"
+)
+
+var variantNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// NewVariant validates the rendition described in config or request and names its processed object.
+func NewVariant(cfg *utils.Config, spec *utils.VariantSpec, id string, rawExt string) (*tasks.Variant, error) {
+	if !variantNamePattern.MatchString(spec.Name) {
+		return nil, fmt.Errorf("invalid variant name %q, expected %s", spec.Name, variantNamePattern)
+	}
+
+	preset := spec.Preset
+	if spec.Use != "" {
+		base, err := LookupPreset(cfg, spec.Use)
+		if err != nil {
+			return nil, fmt.Errorf("variant %q: %w", spec.Name, err)
+		}
+		preset = MergePresets(*base, spec.Preset)
+	}
+
+	options, err := NewConversionOptions(&preset)
+	if err != nil {
+		return nil, fmt.Errorf("variant %q: %w", spec.Name, err)
+	}
+
+	variant := tasks.Variant{
+		Name:   spec.Name,
+		Preset: spec.Use,
+		Resize: options.Resize,
+		Filter: options.Filter,
+		Output: options.Output,
+	}
+	ext := rawExt
+	if variant.Output != nil && variant.Output.Format != "" {
+		ext = variant.Output.Extension()
+	}
+	variant.FilenameProcessed = fmt.Sprintf("%s-processed-%s%s", id, spec.Name, ext)
+	return &variant, nil
+}
+
+// ParseVariantSpecs reads renditions requested either by a named set from config (variant_set)
+// or explicitly as a JSON array (variants). It returns nil if none are requested.
+func ParseVariantSpecs(c *gin.Context, cfg *utils.Config) ([]utils.VariantSpec, error) {
+	setName := c.PostForm("variant_set")
+	raw := c.PostForm("variants")
+
+	var specs []utils.VariantSpec
+	switch {
+	case setName != "" && raw != "":
+		return nil, errors.New("variant_set and variants are mutually exclusive")
+	case setName != "":
+		set, ok := cfg.VariantSets[setName]
+		if !ok {
+			return nil, fmt.Errorf("unknown variant set %q", setName)
+		}
+		specs = set
+	case raw != "":
+		if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+			return nil, fmt.Errorf("invalid variants: %w", err)
+		}
+		if len(specs) == 0 {
+			return nil, errors.New("variants must not be empty")
+		}
+	default:
+		return nil, nil
+	}
+
+	names := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate variant name %q", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	return specs, nil
+}
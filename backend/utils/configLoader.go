@@ -1,51 +1,102 @@
 package utils
 
 import (
-	"github.com/gookit/config/v2"
-	"github.com/gookit/config/v2/yamlv3"
+	"github.com/ojgenbar/Colossus/common/config"
 )
 
 type Config struct {
-	S3      S3      `mapstructure:"s3"`
-	Servers Servers `mapstructure:"servers"`
-	Kafka   Kafka   `mapstructure:"kafka"`
+	Storage       config.Storage `mapstructure:"storage"`
+	StorageHealth StorageHealth  `mapstructure:"storage_health"`
+	S3            config.S3      `mapstructure:"s3"`
+	Servers       Servers        `mapstructure:"servers"`
+	Queue         config.Queue   `mapstructure:"queue"`
+	Kafka         Kafka          `mapstructure:"kafka"`
+	Jobs          Jobs           `mapstructure:"jobs"`
+	Outbox        Outbox         `mapstructure:"outbox"`
+	Reconcile     Reconcile      `mapstructure:"reconcile"`
+	Uploads       Uploads        `mapstructure:"uploads"`
+	Downloads     Downloads      `mapstructure:"downloads"`
+	// Renditions configure GET /images/:id
+	Renditions Renditions `mapstructure:"renditions"`
+	// Presets are named renditions a client may request at upload
+	Presets map[string]config.Preset `mapstructure:"presets"`
+	// VariantSets are named sets of renditions a client may request at upload
+	VariantSets map[string][]VariantSpec `mapstructure:"variant_sets"`
 }
 
-type S3 struct {
-	Auth    S3Auth    `mapstructure:"auth"`
-	Buckets S3Buckets `mapstructure:"buckets"`
+type Servers struct {
+	System config.Server `mapstructure:"system"`
+	Main   config.Server `mapstructure:"main"`
 }
 
-type Servers struct {
-	System Server `mapstructure:"system"`
-	Main   Server `mapstructure:"main"`
+type Kafka struct {
+	BootstrapServers string     `mapstructure:"bootstrap_servers"`
+	ClientId         string     `mapstructure:"client_id"`
+	Acks             string     `mapstructure:"acks"`
+	GroupId          string     `mapstructure:"group_id"`
+	Topic            KafkaTopic `mapstructure:"topic"`
+	StatusTopic      KafkaTopic `mapstructure:"status_topic"`
+	ResultsTopic     KafkaTopic `mapstructure:"results_topic"`
 }
 
-type S3Buckets struct {
-	Raw       S3Bucket `mapstructure:"raw"`
-	Processed S3Bucket `mapstructure:"processed"`
+// StorageHealth configures checks of the object storage, 5s interval and 2s timeout by default.
+type StorageHealth struct {
+	IntervalMs int `mapstructure:"interval_ms"`
+	TimeoutMs  int `mapstructure:"timeout_ms"`
 }
 
-type S3Auth struct {
-	Endpoint        string `mapstructure:"endpoint"`
-	AccessKeyID     string `mapstructure:"accessKeyID"`
-	SecretAccessKey string `mapstructure:"secretAccessKey"`
+// Outbox keeps tasks on disk until they are published, outbox.db and 2s retry interval by default.
+type Outbox struct {
+	Path            string `mapstructure:"path"`
+	RetryIntervalMs int    `mapstructure:"retry_interval_ms"`
+	// BatchSize is the number of messages published before waiting for their acknowledgements, 100 by default
+	BatchSize int `mapstructure:"batch_size"`
 }
 
-type S3Bucket struct {
-	Name     string `mapstructure:"bucketName"`
-	Location string `mapstructure:"location"`
+// Reconcile configures the periodic reconciliation, it is disabled unless IntervalMs is set.
+type Reconcile struct {
+	IntervalMs    int     `mapstructure:"interval_ms"`
+	GracePeriodMs int     `mapstructure:"grace_period_ms"`
+	RatePerSecond float64 `mapstructure:"rate_per_second"`
+	DryRun        bool    `mapstructure:"dry_run"`
 }
 
-type Server struct {
-	Addr string `mapstructure:"addr"`
+// Uploads restrict images accepted by POST /upload-image. Zero limits and empty AllowedFormats
+// accept any supported image.
+type Uploads struct {
+	MaxBytes  int64 `mapstructure:"max_bytes"`
+	MaxWidth  int   `mapstructure:"max_width"`
+	MaxHeight int   `mapstructure:"max_height"`
+	// MaxPixels keeps accepted images within the converter's memory budget per task
+	// (WORKERS_TASK_MEMORY_BYTES): an image turned upright by EXIF takes 12 bytes per pixel there
+	MaxPixels int64 `mapstructure:"max_pixels"`
+	// AllowedFormats is a comma separated list of format names, e.g. "jpeg,png,webp"
+	AllowedFormats string `mapstructure:"allowed_formats"`
 }
 
-type Kafka struct {
-	BootstrapServers string     `mapstructure:"bootstrap_servers"`
-	ClientId         string     `mapstructure:"client_id"`
-	Acks             string     `mapstructure:"acks"`
-	Topic            KafkaTopic `mapstructure:"topic"`
+// Downloads configure GET /retrieve-image. StripRawMetadata removes EXIF (e.g. GPS), XMP and IPTC
+// metadata from raw JPEG, PNG and WebP images, except their orientation. Raw TIFF images keep their
+// metadata in the image directory, they are not served then.
+type Downloads struct {
+	StripRawMetadata bool `mapstructure:"strip_raw_metadata"`
+}
+
+type Jobs struct {
+	Store string `mapstructure:"store"`
+}
+
+type Renditions struct {
+	// Sizes are the allowed WIDTHxHEIGHT boxes, 0 leaves the side unconstrained
+	Sizes  []string `mapstructure:"sizes"`
+	Filter string   `mapstructure:"filter"`
+}
+
+// VariantSpec describes a named rendition. It may be based on a preset,
+// options set explicitly take precedence over the ones of the preset.
+type VariantSpec struct {
+	Name          string `mapstructure:"name" json:"name"`
+	Use           string `mapstructure:"preset" json:"preset,omitempty"`
+	config.Preset `mapstructure:",squash"`
 }
 
 type KafkaTopic struct {
@@ -56,16 +107,7 @@ type KafkaTopic struct {
 func LoadConfig() (*Config, error) {
 	var cfg Config
 
-	config.WithOptions(config.ParseEnv)
-
-	config.AddDriver(yamlv3.Driver)
-
-	err := config.LoadFiles("configs/main.yml")
-	if err != nil {
-		return nil, err
-	}
-
-	err = config.BindStruct("", &cfg)
+	err := config.Load("configs/main.yml", &cfg)
 	if err != nil {
 		return nil, err
 	}
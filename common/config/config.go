@@ -0,0 +1,75 @@
+package config
+
+import (
+	"github.com/gookit/config/v2"
+	"github.com/gookit/config/v2/yamlv3"
+)
+
+// Storage selects the object storage driver: s3 (default) or local.
+type Storage struct {
+	Driver string `mapstructure:"driver"`
+	// Root is the directory of the local driver
+	Root string `mapstructure:"root"`
+}
+
+// Queue selects the message broker: kafka (default) or memory. The memory broker
+// only connects components running in the same process.
+type Queue struct {
+	Driver string `mapstructure:"driver"`
+}
+
+// S3 describes the object storage shared by the services. Every service uses only the buckets it needs.
+type S3 struct {
+	Auth    S3Auth    `mapstructure:"auth"`
+	Buckets S3Buckets `mapstructure:"buckets"`
+}
+
+type S3Buckets struct {
+	Raw        S3Bucket `mapstructure:"raw"`
+	Processed  S3Bucket `mapstructure:"processed"`
+	Jobs       S3Bucket `mapstructure:"jobs"`
+	Renditions S3Bucket `mapstructure:"renditions"`
+}
+
+type S3Auth struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	AccessKeyID     string `mapstructure:"accessKeyID"`
+	SecretAccessKey string `mapstructure:"secretAccessKey"`
+}
+
+type S3Bucket struct {
+	Name     string `mapstructure:"bucketName"`
+	Location string `mapstructure:"location"`
+}
+
+type Server struct {
+	Addr string `mapstructure:"addr"`
+}
+
+// Preset describes resize, filter and output options of a rendition.
+type Preset struct {
+	Width       int    `mapstructure:"width" json:"width,omitempty"`
+	Height      int    `mapstructure:"height" json:"height,omitempty"`
+	Mode        string `mapstructure:"mode" json:"mode,omitempty"`
+	Background  string `mapstructure:"background" json:"background,omitempty"`
+	Upscale     bool   `mapstructure:"upscale" json:"upscale,omitempty"`
+	Filter      string `mapstructure:"filter" json:"filter,omitempty"`
+	Format      string `mapstructure:"format" json:"format,omitempty"`
+	Quality     int    `mapstructure:"quality" json:"quality,omitempty"`
+	Compression string `mapstructure:"compression" json:"compression,omitempty"`
+	Poster      bool   `mapstructure:"poster" json:"poster,omitempty"`
+}
+
+// Load reads the YAML file, expanding ${ENV} placeholders, into cfg.
+func Load(path string, cfg interface{}) error {
+	config.WithOptions(config.ParseEnv)
+
+	config.AddDriver(yamlv3.Driver)
+
+	err := config.LoadFiles(path)
+	if err != nil {
+		return err
+	}
+
+	return config.BindStruct("", cfg)
+}
@@ -0,0 +1,79 @@
+// Package errs classifies failures shared by the services, so the backend can answer
+// with a matching HTTP status and the converter can tell failures worth retrying
+// from permanent ones.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind is the class of a failure. It is also reported to clients in error responses.
+type Kind string
+
+const (
+	Internal           Kind = "internal"
+	Validation         Kind = "validation"
+	NotFound           Kind = "not_found"
+	StorageUnavailable Kind = "storage_unavailable"
+	QueueUnavailable   Kind = "queue_unavailable"
+	UnsupportedMedia   Kind = "unsupported_media"
+	TooLarge           Kind = "too_large"
+	// Unprocessable input made the processing time out or crash
+	Unprocessable Kind = "unprocessable"
+)
+
+// Error is an error of a known kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, message string) error {
+	return &Error{Kind: kind, Err: errors.New(message)}
+}
+
+func Errorf(kind Kind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap classifies err as kind, overriding the kind it may already have. It returns nil for a nil err.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of the outermost classified error in the chain of err,
+// or Internal if there is none.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Internal
+}
+
+// Is reports whether err is of the kind.
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
+
+// Permanent reports whether retrying can not help: the input is invalid, missing, too large
+// or can not be processed. Unavailable dependencies and unclassified failures may go away by themselves.
+func Permanent(err error) bool {
+	switch KindOf(err) {
+	case Validation, NotFound, UnsupportedMedia, TooLarge, Unprocessable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package imaging
+
+import (
+	"github.com/ojgenbar/Colossus/common/errs"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+)
+
+// CountGIFFrames walks the blocks of the GIF without decoding them, so the cost of decoding
+// every frame is known in advance.
+func CountGIFFrames(data []byte) (int, error) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return 0, errs.New(errs.UnsupportedMedia, "not a GIF image")
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	frames := 0
+	for pos < len(data) {
+		var err error
+		switch data[pos] {
+		case 0x21:
+			// Extension: label and data sub-blocks
+			pos, err = skipGIFSubBlocks(data, pos+2)
+		case 0x2C:
+			// Image descriptor, local color table, LZW code size and data sub-blocks
+			if pos+10 > len(data) {
+				return 0, errs.New(errs.UnsupportedMedia, "truncated GIF image descriptor")
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos, err = skipGIFSubBlocks(data, pos+1)
+			frames++
+		case 0x3B:
+			return frames, nil
+		default:
+			return 0, errs.Errorf(errs.UnsupportedMedia, "unknown GIF block 0x%02x", data[pos])
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, errs.New(errs.UnsupportedMedia, "truncated GIF image")
+}
+
+func skipGIFSubBlocks(data []byte, pos int) (int, error) {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos, nil
+		}
+		pos += size
+	}
+	return 0, errs.New(errs.UnsupportedMedia, "truncated GIF data sub-blocks")
+}
+
+// ConvertAnimation resizes every frame of the animated GIF and encodes it as a GIF, keeping the delays,
+// disposal methods and loop count. Frames are resized on their own with their palettes, so parts
+// of the canvas a frame does not cover keep showing the previous frames.
+func ConvertAnimation(g *gif.GIF, output io.Writer, options Options) (image.Rectangle, error) {
+	plan, err := options.plan(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	if plan.canvas.Empty() {
+		return image.Rectangle{}, errs.Errorf(errs.Validation, "animation of %dx%d is resized to nothing", g.Config.Width, g.Config.Height)
+	}
+
+	out := gif.GIF{
+		LoopCount:       g.LoopCount,
+		BackgroundIndex: g.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: g.Config.ColorModel,
+			Width:      plan.canvas.Dx(),
+			Height:     plan.canvas.Dy(),
+		},
+	}
+	for i, frame := range g.Image {
+		var delay int
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		rect, background := planFrame(frame.Rect, plan), color.Color(nil)
+		if i == 0 && (plan.background != nil || rect.Empty()) {
+			// The first frame paints the padding and can not be dropped
+			rect, background = plan.canvas, plan.background
+		}
+		if rect.Empty() {
+			// The frame is cropped out, show the previous one for its time
+			out.Delay[len(out.Delay)-1] += delay
+			continue
+		}
+		out.Image = append(out.Image, resizeFrame(frame, rect, plan, background, options.Filter))
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, disposal)
+	}
+
+	err = gif.EncodeAll(output, &out)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return plan.canvas, nil
+}
+
+// planFrame returns where the part of the source canvas covered by the frame goes on the destination canvas.
+func planFrame(frame image.Rectangle, plan resizePlan) image.Rectangle {
+	src := frame.Intersect(plan.src)
+	if src.Empty() {
+		return image.Rectangle{}
+	}
+	sw, sh := plan.src.Dx(), plan.src.Dy()
+	dw, dh := plan.dst.Dx(), plan.dst.Dy()
+	// Round outwards, so neighbouring frames leave no gaps between them
+	return image.Rect(
+		plan.dst.Min.X+(src.Min.X-plan.src.Min.X)*dw/sw,
+		plan.dst.Min.Y+(src.Min.Y-plan.src.Min.Y)*dh/sh,
+		plan.dst.Min.X+((src.Max.X-plan.src.Min.X)*dw+sw-1)/sw,
+		plan.dst.Min.Y+((src.Max.Y-plan.src.Min.Y)*dh+sh-1)/sh,
+	).Intersect(plan.dst)
+}
+
+// resizeFrame scales the frame into rect and maps the result back to the palette of the frame.
+func resizeFrame(frame *image.Paletted, rect image.Rectangle, plan resizePlan, background color.Color, filter draw.Interpolator) *image.Paletted {
+	scratch := image.NewRGBA(rect)
+	if background != nil {
+		draw.Draw(scratch, rect, image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	if src := frame.Rect.Intersect(plan.src); !src.Empty() {
+		filter.Scale(scratch, planFrame(src, plan), frame, src, draw.Over, nil)
+	}
+	dst := image.NewPaletted(rect, frame.Palette)
+	draw.Draw(dst, rect, scratch, rect.Min, draw.Src)
+	return dst
+}
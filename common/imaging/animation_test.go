@@ -0,0 +1,154 @@
+package imaging
+
+import (
+	"bytes"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/gif"
+	"slices"
+	"testing"
+)
+
+// testAnimation makes a 40x20 animation: a red first frame covering the canvas, a green
+// frame on its right half and a blue one in its top left corner, each with its own palette.
+func testAnimation() *gif.GIF {
+	frame := func(rect image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(rect, color.Palette{color.Black, c})
+		draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+		return img
+	}
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 20), color.RGBA{R: 255, A: 255}),
+			frame(image.Rect(20, 0, 40, 20), color.RGBA{G: 255, A: 255}),
+			frame(image.Rect(0, 0, 10, 10), color.RGBA{B: 255, A: 255}),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		LoopCount: 3,
+		Config:    image.Config{Width: 40, Height: 20},
+	}
+}
+
+func encodeGIF(t *testing.T, g *gif.GIF) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	data := encodeGIF(t, testAnimation())
+	single := encodeGIF(t, &gif.GIF{
+		Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black})},
+		Delay: []int{0},
+	})
+	tests := []struct {
+		name string
+		data []byte
+		want int
+		err  errs.Kind
+	}{
+		{"animation", data, 3, ""},
+		{"single frame", single, 1, ""},
+		{"not a GIF", []byte("\x89PNG\r\n\x1a\n0000000000"), 0, errs.UnsupportedMedia},
+		{"header only", data[:13], 0, errs.UnsupportedMedia},
+		{"truncated frame", data[:len(data)-10], 0, errs.UnsupportedMedia},
+		{"missing trailer", data[:len(data)-1], 0, errs.UnsupportedMedia},
+		{"unknown block", append(slices.Clone(data[:len(data)-1]), 0x42), 0, errs.UnsupportedMedia},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CountGIFFrames(tt.data)
+			if tt.err != "" {
+				if !errs.Is(err, tt.err) {
+					t.Fatalf("got %d frames and %v, want %s", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %d frames and %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func convertAnimation(t *testing.T, options Options) *gif.GIF {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := ConvertAnimation(testAnimation(), &buf, options); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestConvertAnimation(t *testing.T) {
+	g := convertAnimation(t, Options{
+		Resize: &ResizeSpec{Width: 20, Mode: ResizeModeFit},
+		Filter: draw.NearestNeighbor,
+	})
+
+	if g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Errorf("canvas of %dx%d, want 20x10", g.Config.Width, g.Config.Height)
+	}
+	if !slices.Equal(g.Delay, []int{10, 20, 30}) {
+		t.Errorf("delays %v", g.Delay)
+	}
+	if !slices.Equal(g.Disposal, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious}) {
+		t.Errorf("disposal %v", g.Disposal)
+	}
+	if g.LoopCount != 3 {
+		t.Errorf("loop count %d, want 3", g.LoopCount)
+	}
+	wantRects := []image.Rectangle{image.Rect(0, 0, 20, 10), image.Rect(10, 0, 20, 10), image.Rect(0, 0, 5, 5)}
+	wantColors := []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+	for i, frame := range g.Image {
+		if frame.Rect != wantRects[i] {
+			t.Errorf("frame %d at %v, want %v", i, frame.Rect, wantRects[i])
+		}
+		if got := color.RGBAModel.Convert(frame.At(frame.Rect.Min.X, frame.Rect.Min.Y)); got != wantColors[i] {
+			t.Errorf("frame %d is %v, want %v", i, got, wantColors[i])
+		}
+	}
+}
+
+func TestConvertAnimationCroppedFrame(t *testing.T) {
+	// Filling a square crops the center, the corner of the third frame is cropped out
+	g := convertAnimation(t, Options{
+		Resize: &ResizeSpec{Width: 10, Height: 10, Mode: ResizeModeFill},
+		Filter: draw.NearestNeighbor,
+	})
+
+	if g.Config.Width != 10 || g.Config.Height != 10 {
+		t.Errorf("canvas of %dx%d, want 10x10", g.Config.Width, g.Config.Height)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("%d frames, want 2", len(g.Image))
+	}
+	// The dropped frame's time goes to the one shown instead
+	if !slices.Equal(g.Delay, []int{10, 50}) {
+		t.Errorf("delays %v, want [10 50]", g.Delay)
+	}
+	if want := image.Rect(5, 0, 10, 10); g.Image[1].Rect != want {
+		t.Errorf("second frame at %v, want %v", g.Image[1].Rect, want)
+	}
+}
+
+func TestConvertAnimationEmptyCanvas(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := ConvertAnimation(testAnimation(), &buf, Options{K: 50, Filter: draw.NearestNeighbor})
+	if !errs.Is(err, errs.Validation) {
+		t.Fatalf("got %v, want %s", err, errs.Validation)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written", buf.Len())
+	}
+}
@@ -0,0 +1,604 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"sort"
+	"strings"
+)
+
+// EXIF tags handled by the package.
+const (
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+)
+
+// safeExifTags may be kept in converted images: they describe the picture and the camera,
+// but not where it was taken or which device exactly took it.
+var safeExifTags = map[uint16]string{
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9204: "ExposureBiasValue",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0xA001: "ColorSpace",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+}
+
+// maxExifEntries limits entries read from a single IFD of untrusted input.
+const maxExifEntries = 512
+
+var errInvalidExif = errors.New("invalid EXIF data")
+
+// ExifTag is a raw entry of an IFD, Value is in the byte order of the Exif it belongs to.
+type ExifTag struct {
+	ID    uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// Exif holds the entries of IFD0 and of the Exif sub-IFD. Other IFDs, e.g. GPS, are not kept.
+type Exif struct {
+	order       binary.ByteOrder
+	Main        []ExifTag
+	Photo       []ExifTag
+	orientation int
+}
+
+// Orientation returns the EXIF orientation, 1 (as is) when it is not set.
+func (e *Exif) Orientation() int {
+	if e == nil || e.orientation < 1 || e.orientation > 8 {
+		return 1
+	}
+	return e.orientation
+}
+
+// Text returns the value of an ASCII tag of the safe allowlist by its name, e.g. "Model",
+// or an empty string if it is not set.
+func (e *Exif) Text(name string) string {
+	if e == nil {
+		return ""
+	}
+	for _, tags := range [][]ExifTag{e.Main, e.Photo} {
+		for _, tag := range tags {
+			if safeExifTags[tag.ID] == name && tag.Type == 2 {
+				return strings.TrimSpace(strings.TrimRight(string(tag.Value), "\x00"))
+			}
+		}
+	}
+	return ""
+}
+
+// Safe returns the tags of the safe allowlist, or nil if there are none. Orientation is dropped,
+// it is expected to be applied to the pixels.
+func (e *Exif) Safe() *Exif {
+	return e.filter(func(id uint16) bool {
+		_, ok := safeExifTags[id]
+		return ok
+	})
+}
+
+// OrientationOnly returns the orientation tag alone, or nil if it is not set.
+func (e *Exif) OrientationOnly() *Exif {
+	return e.filter(func(id uint16) bool { return id == tagOrientation })
+}
+
+func (e *Exif) filter(keep func(id uint16) bool) *Exif {
+	if e == nil {
+		return nil
+	}
+	filtered := &Exif{order: e.order}
+	for _, tag := range e.Main {
+		if keep(tag.ID) {
+			filtered.Main = append(filtered.Main, tag)
+			if tag.ID == tagOrientation {
+				filtered.orientation = e.orientation
+			}
+		}
+	}
+	for _, tag := range e.Photo {
+		if keep(tag.ID) {
+			filtered.Photo = append(filtered.Photo, tag)
+		}
+	}
+	if len(filtered.Main) == 0 && len(filtered.Photo) == 0 {
+		return nil
+	}
+	return filtered
+}
+
+// ReadExif returns the EXIF metadata of a JPEG, PNG, WebP or TIFF image, or nil if it has none.
+func ReadExif(data []byte, format *ImageFormat) (*Exif, error) {
+	var tiff []byte
+	switch format.Name {
+	case "jpeg":
+		for _, segment := range jpegSegments(data) {
+			if segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, jpegExifHeader) {
+				tiff = segment.payload[len(jpegExifHeader):]
+				break
+			}
+		}
+	case "png":
+		for _, chunk := range pngChunks(data) {
+			if chunk.typ == "eXIf" {
+				tiff = chunk.data
+				break
+			}
+		}
+	case "webp":
+		tiff = webpExifChunk(data)
+	case "tiff":
+		tiff = data
+	}
+	if tiff == nil {
+		return nil, nil
+	}
+	return ParseExif(tiff)
+}
+
+// ParseExif reads a TIFF structure holding EXIF metadata.
+func ParseExif(tiff []byte) (*Exif, error) {
+	if len(tiff) < 8 {
+		return nil, errInvalidExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errInvalidExif
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, errInvalidExif
+	}
+
+	e := &Exif{order: order}
+	var err error
+	e.Main, err = readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range e.Main {
+		switch tag.ID {
+		case tagOrientation:
+			if tag.Type == 3 && len(tag.Value) >= 2 {
+				e.orientation = int(order.Uint16(tag.Value))
+			}
+		case tagExifIFD:
+			if len(tag.Value) >= 4 {
+				// A broken sub-IFD does not make the main one useless
+				e.Photo, _ = readIFD(tiff, order, order.Uint32(tag.Value))
+			}
+		}
+	}
+	return e, nil
+}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([]ExifTag, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errInvalidExif
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	if count > maxExifEntries || uint64(offset)+2+uint64(count)*12 > uint64(len(tiff)) {
+		return nil, errInvalidExif
+	}
+
+	tags := make([]ExifTag, 0, count)
+	for i := 0; i < count; i++ {
+		entry := tiff[offset+2+uint32(i)*12:]
+		tag := ExifTag{
+			ID:    order.Uint16(entry),
+			Type:  order.Uint16(entry[2:]),
+			Count: order.Uint32(entry[4:]),
+		}
+		size := uint64(exifTypeSize(tag.Type)) * uint64(tag.Count)
+		if size == 0 {
+			continue
+		}
+		if size <= 4 {
+			tag.Value = append([]byte(nil), entry[8:8+size]...)
+		} else {
+			valueOffset := uint64(order.Uint32(entry[8:]))
+			if valueOffset+size > uint64(len(tiff)) {
+				continue
+			}
+			tag.Value = append([]byte(nil), tiff[valueOffset:valueOffset+size]...)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func exifTypeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return 0
+}
+
+// Encode returns the metadata as a TIFF structure, as embedded in JPEG APP1 or PNG eXIf.
+func (e *Exif) Encode() []byte {
+	order := e.order
+	main := sortedTags(e.Main, tagExifIFD, tagGPSIFD)
+	photo := sortedTags(e.Photo)
+	if len(photo) > 0 {
+		// The offset is set once the size of IFD0 is known
+		main = sortedTags(append(main, ExifTag{ID: tagExifIFD, Type: 4, Count: 1, Value: make([]byte, 4)}))
+	}
+
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	header := make([]byte, 6)
+	order.PutUint16(header, 42)
+	order.PutUint32(header[2:], 8)
+	buf.Write(header)
+
+	photoOffset := 8 + ifdSize(main)
+	for i := range main {
+		if main[i].ID == tagExifIFD {
+			order.PutUint32(main[i].Value, photoOffset)
+		}
+	}
+	writeIFD(&buf, order, main)
+	if len(photo) > 0 {
+		writeIFD(&buf, order, photo)
+	}
+	return buf.Bytes()
+}
+
+func sortedTags(tags []ExifTag, skip ...uint16) []ExifTag {
+	sorted := make([]ExifTag, 0, len(tags))
+	for _, tag := range tags {
+		skipped := false
+		for _, id := range skip {
+			skipped = skipped || tag.ID == id
+		}
+		if !skipped {
+			sorted = append(sorted, tag)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+// ifdSize returns the size of the IFD with the values which do not fit into entries, padded to an even size.
+func ifdSize(tags []ExifTag) uint32 {
+	size := uint32(2 + len(tags)*12 + 4)
+	for _, tag := range tags {
+		if len(tag.Value) > 4 {
+			size += uint32(len(tag.Value)+1) &^ 1
+		}
+	}
+	return size
+}
+
+func writeIFD(buf *bytes.Buffer, order binary.ByteOrder, tags []ExifTag) {
+	start := uint32(buf.Len())
+	valueOffset := start + uint32(2+len(tags)*12+4)
+
+	entries := make([]byte, 2+len(tags)*12+4)
+	order.PutUint16(entries, uint16(len(tags)))
+	var values []byte
+	for i, tag := range tags {
+		entry := entries[2+i*12:]
+		order.PutUint16(entry, tag.ID)
+		order.PutUint16(entry[2:], tag.Type)
+		order.PutUint32(entry[4:], tag.Count)
+		if len(tag.Value) <= 4 {
+			copy(entry[8:12], tag.Value)
+			continue
+		}
+		order.PutUint32(entry[8:], valueOffset+uint32(len(values)))
+		values = append(values, tag.Value...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	buf.Write(entries)
+	buf.Write(values)
+}
+
+// Orient transforms the image as requested by the EXIF orientation, so it is displayed upright
+// without the tag.
+func Orient(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Rect, src, b.Min, draw.Src)
+	}
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for sy := 0; sy < h; sy++ {
+		row := rgba.Pix[sy*rgba.Stride : sy*rgba.Stride+w*4]
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-sx, sy
+			case 3: // rotated 180°
+				dx, dy = w-1-sx, h-1-sy
+			case 4: // mirrored vertically
+				dx, dy = sx, h-1-sy
+			case 5: // transposed
+				dx, dy = sy, sx
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-sy, sx
+			case 7: // transversed
+				dx, dy = h-1-sy, w-1-sx
+			case 8: // rotated 90° counterclockwise
+				dx, dy = sy, w-1-sx
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], row[sx*4:sx*4+4])
+		}
+	}
+	return dst
+}
+
+// WithExif replaces the metadata of an encoded JPEG, PNG or WebP image: EXIF, XMP, IPTC and text chunks
+// are removed and exif is embedded instead, unless it is nil. Other formats are returned as they are.
+func WithExif(data []byte, format *ImageFormat, exif *Exif) []byte {
+	switch format.Name {
+	case "jpeg":
+		return jpegWithExif(data, exif)
+	case "png":
+		return pngWithExif(data, exif)
+	case "webp":
+		return webpWithExif(data, exif)
+	}
+	return data
+}
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	// jpegExtendedXMPHeader starts segments continuing XMP packets too large for a single one
+	jpegExtendedXMPHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+	raw     []byte
+}
+
+// jpegSegments returns the segments preceding the image data, the rest of data is not a segment.
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	var segments []jpegSegment
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{
+			marker:  marker,
+			payload: data[pos+4 : pos+2+length],
+			raw:     data[pos : pos+2+length],
+		})
+		pos += 2 + length
+	}
+	return segments
+}
+
+func jpegWithExif(data []byte, exif *Exif) []byte {
+	segments := jpegSegments(data)
+	if segments == nil {
+		return data
+	}
+	rest := data[2:]
+	for _, segment := range segments {
+		rest = rest[len(segment.raw):]
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	written := exif == nil
+	for _, segment := range segments {
+		if !written && segment.marker != 0xE0 {
+			writeJPEGExif(&buf, exif)
+			written = true
+		}
+		switch {
+		case segment.marker == 0xE1 && (bytes.HasPrefix(segment.payload, jpegExifHeader) ||
+			bytes.HasPrefix(segment.payload, jpegXMPHeader) || bytes.HasPrefix(segment.payload, jpegExtendedXMPHeader)):
+		case segment.marker == 0xED: // Photoshop IRB with IPTC
+		default:
+			buf.Write(segment.raw)
+		}
+	}
+	if !written {
+		writeJPEGExif(&buf, exif)
+	}
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+func writeJPEGExif(buf *bytes.Buffer, exif *Exif) {
+	payload := append(append([]byte(nil), jpegExifHeader...), exif.Encode()...)
+	if len(payload)+2 > 0xFFFF {
+		return
+	}
+	buf.Write([]byte{0xFF, 0xE1})
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngChunk struct {
+	typ  string
+	data []byte
+	raw  []byte
+}
+
+func pngChunks(data []byte) []pngChunk {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		chunks = append(chunks, pngChunk{
+			typ:  string(data[pos+4 : pos+8]),
+			data: data[pos+8 : pos+8+length],
+			raw:  data[pos : pos+12+length],
+		})
+		pos += 12 + length
+	}
+	return chunks
+}
+
+func pngWithExif(data []byte, exif *Exif) []byte {
+	chunks := pngChunks(data)
+	if chunks == nil {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			continue
+		}
+		buf.Write(chunk.raw)
+		if chunk.typ == "IHDR" && exif != nil {
+			writePNGChunk(&buf, "eXIf", exif.Encode())
+		}
+	}
+	return buf.Bytes()
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	_ = binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// webpExifChunk returns the EXIF chunk of an extended WebP image.
+func webpExifChunk(data []byte) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil
+		}
+		if string(data[pos:pos+4]) == "EXIF" {
+			return bytes.TrimPrefix(data[pos+8:pos+8+size], jpegExifHeader)
+		}
+		pos += 8 + size + size%2
+	}
+	return nil
+}
+
+// Flags of the VP8X chunk telling which metadata chunks follow
+const (
+	webpFlagXMP  = 0x04
+	webpFlagExif = 0x08
+)
+
+// webpWithExif rewrites the RIFF container without the EXIF and XMP chunks. Only extended WebP
+// images, starting with a VP8X chunk, may carry metadata, so exif is embedded in those only.
+func webpWithExif(data []byte, exif *Exif) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:12])
+	extended := false
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return data
+		}
+		end := min(pos+8+size+size%2, len(data))
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			extended = true
+			chunk := append([]byte(nil), data[pos:end]...)
+			if size > 0 {
+				chunk[8] &^= webpFlagXMP | webpFlagExif
+				if exif != nil {
+					chunk[8] |= webpFlagExif
+				}
+			}
+			buf.Write(chunk)
+		default:
+			buf.Write(data[pos:end])
+		}
+		pos = end
+	}
+	if extended && exif != nil {
+		// The EXIF chunk follows the image data
+		tiff := exif.Encode()
+		_, _ = buf.WriteString("EXIF")
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(tiff)))
+		buf.Write(tiff)
+		if len(tiff)%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
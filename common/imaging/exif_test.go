@@ -0,0 +1,404 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// Tags of the test metadata
+const (
+	tagMake             = 0x010F
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitude      = 0x0002
+)
+
+func asciiTag(id uint16, value string) ExifTag {
+	return ExifTag{ID: id, Type: 2, Count: uint32(len(value) + 1), Value: append([]byte(value), 0)}
+}
+
+func shortTag(order binary.ByteOrder, id uint16, value uint16) ExifTag {
+	v := make([]byte, 2)
+	order.PutUint16(v, value)
+	return ExifTag{ID: id, Type: 3, Count: 1, Value: v}
+}
+
+// buildTIFF lays out IFD0, the Exif sub-IFD and the GPS sub-IFD the way cameras do, independently of Encode.
+// Sub-IFDs are linked from IFD0 only if they have tags.
+func buildTIFF(order binary.ByteOrder, main, photo, gps []ExifTag) []byte {
+	header := []byte("II\x00\x00\x00\x00\x00\x00")
+	if order == binary.BigEndian {
+		copy(header, "MM")
+	}
+	order.PutUint16(header[2:], 42)
+	order.PutUint32(header[4:], 8)
+
+	// Pointers are placeholders until the offsets of the sub-IFDs are known
+	main = slices.Clone(main)
+	pointers := map[uint16][]ExifTag{tagExifIFD: photo, tagGPSIFD: gps}
+	for _, id := range []uint16{tagExifIFD, tagGPSIFD} {
+		if len(pointers[id]) > 0 {
+			main = append(main, ExifTag{ID: id, Type: 4, Count: 1, Value: make([]byte, 4)})
+		}
+	}
+	tiff := appendIFD(header, order, main)
+	for _, id := range []uint16{tagExifIFD, tagGPSIFD} {
+		if len(pointers[id]) == 0 {
+			continue
+		}
+		offset := uint32(len(tiff))
+		for i, tag := range main {
+			if tag.ID == id {
+				order.PutUint32(tiff[8+2+i*12+8:], offset)
+			}
+		}
+		tiff = appendIFD(tiff, order, pointers[id])
+	}
+	return tiff
+}
+
+func appendIFD(tiff []byte, byteOrder binary.ByteOrder, tags []ExifTag) []byte {
+	order := byteOrder.(binary.AppendByteOrder)
+	valueOffset := len(tiff) + 2 + len(tags)*12 + 4
+	var values []byte
+	tiff = order.AppendUint16(tiff, uint16(len(tags)))
+	for _, tag := range tags {
+		tiff = order.AppendUint16(tiff, tag.ID)
+		tiff = order.AppendUint16(tiff, tag.Type)
+		tiff = order.AppendUint32(tiff, tag.Count)
+		if len(tag.Value) <= 4 {
+			tiff = append(tiff, append(slices.Clone(tag.Value), make([]byte, 4-len(tag.Value))...)...)
+			continue
+		}
+		tiff = order.AppendUint32(tiff, uint32(valueOffset+len(values)))
+		values = append(values, tag.Value...)
+	}
+	tiff = order.AppendUint32(tiff, 0)
+	return append(tiff, values...)
+}
+
+// cameraTIFF returns metadata with an orientation, a camera, a date and a location.
+func cameraTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	return buildTIFF(order,
+		[]ExifTag{shortTag(order, tagOrientation, orientation), asciiTag(tagMake, "Colossus Camera")},
+		[]ExifTag{asciiTag(tagDateTimeOriginal, "2026:01:01 12:00:00")},
+		[]ExifTag{{ID: tagGPSLatitude, Type: 5, Count: 3, Value: make([]byte, 24)}},
+	)
+}
+
+func tagIDs(tags []ExifTag) []uint16 {
+	var ids []uint16
+	for _, tag := range tags {
+		ids = append(ids, tag.ID)
+	}
+	return ids
+}
+
+func TestExifRoundTrip(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			exif, err := ParseExif(cameraTIFF(order, 6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exif.Orientation() != 6 || exif.Text("Make") != "Colossus Camera" || exif.Text("DateTimeOriginal") != "2026:01:01 12:00:00" {
+				t.Fatalf("parsed orientation %d, make %q, date %q", exif.Orientation(), exif.Text("Make"), exif.Text("DateTimeOriginal"))
+			}
+
+			// The GPS IFD is not kept, so its pointer is not written back
+			encoded := exif.Encode()
+			if bytes.Contains(encoded, order.(binary.AppendByteOrder).AppendUint16(nil, tagGPSIFD)) {
+				t.Errorf("encoded metadata points to the GPS IFD")
+			}
+			decoded, err := ParseExif(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(tagIDs(decoded.Main), []uint16{tagMake, tagOrientation, tagExifIFD}) {
+				t.Errorf("IFD0 tags %x", tagIDs(decoded.Main))
+			}
+			if !slices.Equal(tagIDs(decoded.Photo), []uint16{tagDateTimeOriginal}) {
+				t.Errorf("Exif IFD tags %x", tagIDs(decoded.Photo))
+			}
+			if decoded.Orientation() != 6 || decoded.Text("Make") != "Colossus Camera" || decoded.Text("DateTimeOriginal") != "2026:01:01 12:00:00" {
+				t.Errorf("decoded orientation %d, make %q, date %q", decoded.Orientation(), decoded.Text("Make"), decoded.Text("DateTimeOriginal"))
+			}
+
+			safe := exif.Safe()
+			if safe.Orientation() != 1 || safe.Text("Make") == "" || safe.Text("DateTimeOriginal") == "" {
+				t.Errorf("safe tags %x %x", tagIDs(safe.Main), tagIDs(safe.Photo))
+			}
+			only := exif.OrientationOnly()
+			if only.Orientation() != 6 || !slices.Equal(tagIDs(only.Main), []uint16{tagOrientation}) || only.Photo != nil {
+				t.Errorf("orientation only tags %x %x", tagIDs(only.Main), tagIDs(only.Photo))
+			}
+		})
+	}
+}
+
+func TestParseExifMalformed(t *testing.T) {
+	le := binary.LittleEndian
+	valid := cameraTIFF(le, 3)
+	patched := func(offset int, value uint32) []byte {
+		b := slices.Clone(valid)
+		le.PutUint32(b[offset:], value)
+		return b
+	}
+	entryCount := func(count uint16) []byte {
+		b := slices.Clone(valid)
+		le.PutUint16(b[8:], count)
+		return b
+	}
+	// IFD0 entries: orientation, make, Exif IFD pointer, GPS IFD pointer
+	entryValue := func(i int) int { return 8 + 2 + i*12 + 8 }
+
+	tests := []struct {
+		name    string
+		tiff    []byte
+		wantErr bool
+		// wantMain and wantPhoto count the tags of IFD0 and of the Exif IFD after parsing
+		wantMain  int
+		wantPhoto int
+	}{
+		{name: "empty", tiff: nil, wantErr: true},
+		{name: "truncated header", tiff: valid[:6], wantErr: true},
+		{name: "unknown byte order", tiff: append([]byte("XX"), valid[2:]...), wantErr: true},
+		{name: "wrong magic", tiff: append([]byte("II\x2b\x00"), valid[4:]...), wantErr: true},
+		{name: "IFD0 beyond the data", tiff: patched(4, uint32(len(valid))), wantErr: true},
+		{name: "IFD0 offset overflowing", tiff: patched(4, 0xFFFFFFFF), wantErr: true},
+		{name: "entries beyond the data", tiff: entryCount(400), wantErr: true},
+		{name: "too many entries", tiff: entryCount(maxExifEntries + 1), wantErr: true},
+		{name: "truncated IFD0", tiff: valid[:8+2+12], wantErr: true},
+		{name: "value beyond the data", tiff: patched(entryValue(1), uint32(len(valid))), wantMain: 3, wantPhoto: 1},
+		{name: "broken Exif IFD", tiff: patched(entryValue(2), 0xFFFFFFF0), wantMain: 4},
+		{name: "valid", tiff: valid, wantMain: 4, wantPhoto: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exif, err := ParseExif(tt.tiff)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", exif)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exif.Main) != tt.wantMain || len(exif.Photo) != tt.wantPhoto {
+				t.Errorf("parsed %d and %d tags, want %d and %d", len(exif.Main), len(exif.Photo), tt.wantMain, tt.wantPhoto)
+			}
+			if exif.Orientation() != 3 {
+				t.Errorf("orientation %d, want 3", exif.Orientation())
+			}
+		})
+	}
+}
+
+func TestExifOrientationOutOfRange(t *testing.T) {
+	for _, orientation := range []uint16{0, 9, 0xFFFF} {
+		exif, err := ParseExif(cameraTIFF(binary.LittleEndian, orientation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exif.Orientation() != 1 {
+			t.Errorf("orientation %d is read as %d, want 1", orientation, exif.Orientation())
+		}
+	}
+	if (*Exif)(nil).Orientation() != 1 {
+		t.Error("orientation without metadata is not 1")
+	}
+}
+
+// labeled returns an image whose pixels are labeled by their red channel, row by row.
+func labeled(rows ...string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, label := range row {
+			img.Set(x, y, color.RGBA{R: uint8(label), A: 255})
+		}
+	}
+	return img
+}
+
+func labels(img image.Image) []string {
+	b := img.Bounds()
+	var rows []string
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var row []byte
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8))
+		}
+		rows = append(rows, string(row))
+	}
+	return rows
+}
+
+func TestOrient(t *testing.T) {
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{1, []string{"ABC", "DEF"}},
+		{2, []string{"CBA", "FED"}},
+		{3, []string{"FED", "CBA"}},
+		{4, []string{"DEF", "ABC"}},
+		{5, []string{"AD", "BE", "CF"}},
+		{6, []string{"DA", "EB", "FC"}},
+		{7, []string{"FC", "EB", "DA"}},
+		{8, []string{"CF", "BE", "AD"}},
+		{0, []string{"ABC", "DEF"}},
+		{9, []string{"ABC", "DEF"}},
+	}
+	for _, tt := range tests {
+		src := labeled("ABC", "DEF")
+		if got := labels(Orient(src, tt.orientation)); !slices.Equal(got, tt.want) {
+			t.Errorf("orientation %d: %q, want %q", tt.orientation, got, tt.want)
+		}
+
+		// Sources which are not RGBA at the origin are copied first
+		offset := image.NewNRGBA(image.Rect(5, 5, 8, 7))
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				offset.Set(5+x, 5+y, src.At(x, y))
+			}
+		}
+		if got := labels(Orient(offset, tt.orientation)); !slices.Equal(got, tt.want) {
+			t.Errorf("orientation %d of an offset NRGBA image: %q, want %q", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+func appendJPEGSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func TestJPEGWithExif(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, labeled("ABC", "DEF"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	data = append(data, encoded.Bytes()[:2]...)
+	data = append(data, appendJPEGSegment(0xE1, append(slices.Clone(jpegExifHeader), cameraTIFF(binary.BigEndian, 6)...))...)
+	data = append(data, appendJPEGSegment(0xE1, append(slices.Clone(jpegXMPHeader), "<xmp>location</xmp>"...))...)
+	data = append(data, appendJPEGSegment(0xE1, append(slices.Clone(jpegExtendedXMPHeader), "<xmp>more location</xmp>"...))...)
+	data = append(data, appendJPEGSegment(0xED, []byte("Photoshop 3.0\x00location"))...)
+	data = append(data, encoded.Bytes()[2:]...)
+
+	format, err := FormatByName("jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif, err := ReadExif(data, format)
+	if err != nil || exif.Orientation() != 6 {
+		t.Fatalf("read orientation %d, %v", exif.Orientation(), err)
+	}
+
+	stripped := WithExif(data, format, exif.OrientationOnly())
+	if bytes.Contains(stripped, []byte("location")) || bytes.Contains(stripped, []byte("Colossus Camera")) {
+		t.Errorf("metadata is left after stripping")
+	}
+	kept, err := ReadExif(stripped, format)
+	if err != nil || kept.Orientation() != 6 || len(kept.Main) != 1 || kept.Photo != nil {
+		t.Errorf("kept %+v, %v, want the orientation alone", kept, err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image does not decode: %s", err)
+	}
+
+	none := WithExif(data, format, nil)
+	if exif, err := ReadExif(none, format); exif != nil || err != nil {
+		t.Errorf("metadata %+v, %v is left after removing it", exif, err)
+	}
+}
+
+func TestPNGWithExif(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, labeled("ABC", "DEF")); err != nil {
+		t.Fatal(err)
+	}
+	chunks := pngChunks(encoded.Bytes())
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, chunk := range chunks {
+		buf.Write(chunk.raw)
+		if chunk.typ == "IHDR" {
+			writePNGChunk(&buf, "eXIf", cameraTIFF(binary.LittleEndian, 8))
+			writePNGChunk(&buf, "tEXt", []byte("Comment\x00location"))
+			writePNGChunk(&buf, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<xmp>location</xmp>"))
+		}
+	}
+
+	format, err := FormatByName("png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := WithExif(buf.Bytes(), format, &Exif{order: binary.LittleEndian, Main: []ExifTag{shortTag(binary.LittleEndian, tagOrientation, 8)}, orientation: 8})
+	if bytes.Contains(stripped, []byte("location")) || bytes.Contains(stripped, []byte("Colossus Camera")) {
+		t.Errorf("metadata is left after stripping")
+	}
+	kept, err := ReadExif(stripped, format)
+	if err != nil || kept.Orientation() != 8 || len(kept.Main) != 1 {
+		t.Errorf("kept %+v, %v, want the orientation alone", kept, err)
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image does not decode: %s", err)
+	}
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(typ), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestWebPWithExif(t *testing.T) {
+	var body []byte
+	body = append(body, webpChunk("VP8X", []byte{webpFlagXMP | webpFlagExif, 0, 0, 0, 2, 0, 0, 1, 0, 0})...)
+	body = append(body, webpChunk("VP8L", []byte{1, 2, 3})...)
+	body = append(body, webpChunk("EXIF", cameraTIFF(binary.LittleEndian, 6))...)
+	body = append(body, webpChunk("XMP ", []byte("<xmp>location</xmp>"))...)
+	data := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(4+len(body)))
+	data = append(append(data, "WEBP"...), body...)
+
+	format, err := FormatByName("webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exif, err := ReadExif(data, format)
+	if err != nil || exif.Orientation() != 6 {
+		t.Fatalf("read orientation %d, %v", exif.Orientation(), err)
+	}
+
+	stripped := WithExif(data, format, exif.OrientationOnly())
+	if bytes.Contains(stripped, []byte("location")) || bytes.Contains(stripped, []byte("Colossus Camera")) {
+		t.Errorf("metadata is left after stripping")
+	}
+	if flags := stripped[20]; flags != webpFlagExif {
+		t.Errorf("VP8X flags %#x, want EXIF only", flags)
+	}
+	if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+		t.Errorf("RIFF size %d of %d bytes", size, len(stripped))
+	}
+	kept, err := ReadExif(stripped, format)
+	if err != nil || kept.Orientation() != 6 || len(kept.Main) != 1 {
+		t.Errorf("kept %+v, %v, want the orientation alone", kept, err)
+	}
+
+	none := WithExif(data, format, nil)
+	if none[20] != 0 || bytes.Contains(none, []byte("EXIF")) {
+		t.Errorf("metadata is left after removing it")
+	}
+}
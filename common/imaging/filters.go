@@ -0,0 +1,50 @@
+package imaging
+
+import (
+	"github.com/ojgenbar/Colossus/common/errs"
+	"golang.org/x/image/draw"
+	"math"
+)
+
+const DefaultFilter = "nearest"
+
+// Lanczos is the Lanczos-3 resampling kernel. It gives the sharpest result and is the slowest one.
+var Lanczos = &draw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		if t >= 3 {
+			return 0
+		}
+		t *= math.Pi
+		return 3 * math.Sin(t) * math.Sin(t/3) / (t * t)
+	},
+}
+
+var filters = map[string]draw.Interpolator{
+	"nearest":         draw.NearestNeighbor,
+	"approx-bilinear": draw.ApproxBiLinear,
+	"bilinear":        draw.BiLinear,
+	"catmull-rom":     draw.CatmullRom,
+	"lanczos":         Lanczos,
+}
+
+// Filters lists names of the supported resampling filters.
+var Filters = []string{"nearest", "approx-bilinear", "bilinear", "catmull-rom", "lanczos"}
+
+// GetFilter returns the interpolator by name, falling back to the default one for an empty name.
+func GetFilter(name string, defaultName string) (draw.Interpolator, error) {
+	if name == "" {
+		name = defaultName
+	}
+	if name == "" {
+		name = DefaultFilter
+	}
+	filter, ok := filters[name]
+	if !ok {
+		return nil, errs.Errorf(errs.Validation, "unknown filter %q", name)
+	}
+	return filter, nil
+}
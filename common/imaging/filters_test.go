@@ -0,0 +1,150 @@
+package imaging
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden images in testdata")
+
+// goldenSource draws a gradient with a checkerboard and a diagonal, so both smooth areas
+// and hard edges show how a filter resamples them.
+func goldenSource() *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: 128, A: 255}
+			if (x/8+y/8)%2 == 0 && x < 32 {
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+			if x == y {
+				c = color.RGBA{A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	return src
+}
+
+func TestFiltersGolden(t *testing.T) {
+	tests := []struct {
+		filter string
+		width  int
+		height int
+	}{
+		{"nearest", 24, 18},
+		{"approx-bilinear", 24, 18},
+		{"bilinear", 24, 18},
+		{"catmull-rom", 24, 18},
+		{"lanczos", 24, 18},
+		{"nearest", 96, 72},
+		{"bilinear", 96, 72},
+		{"lanczos", 96, 72},
+	}
+	src := goldenSource()
+	for _, tt := range tests {
+		name := filepath.Join("testdata", "golden", fmt.Sprintf("%s-%dx%d.png", tt.filter, tt.width, tt.height))
+		t.Run(name, func(t *testing.T) {
+			filter, err := GetFilter(tt.filter, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			format, err := FormatByName("png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			_, err = Convert(src, &out, format, Options{
+				Resize: &ResizeSpec{Width: tt.width, Height: tt.height, Mode: ResizeModeStretch, Upscale: true},
+				Filter: filter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := png.Decode(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatalf("%s, run with -update to create it", err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			comparePixels(t, got, want)
+		})
+	}
+}
+
+func comparePixels(t *testing.T, got image.Image, want image.Image) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds %v, want %v", got.Bounds(), want.Bounds())
+	}
+	b := got.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.NRGBAModel.Convert(got.At(x, y))
+			w := color.NRGBAModel.Convert(want.At(x, y))
+			if g != w {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestLanczosKernel(t *testing.T) {
+	tests := []struct {
+		t    float64
+		want float64
+	}{
+		{0, 1},
+		{1, 0},
+		{2, 0},
+		{0.5, 6 / (math.Pi * math.Pi)},
+		{-0.5, 6 / (math.Pi * math.Pi)},
+		{3, 0},
+		{3.5, 0},
+		{100, 0},
+	}
+	for _, tt := range tests {
+		got := Lanczos.At(tt.t)
+		if math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("Lanczos.At(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestGetFilter(t *testing.T) {
+	for _, name := range Filters {
+		if _, err := GetFilter(name, ""); err != nil {
+			t.Errorf("GetFilter(%q): %s", name, err)
+		}
+	}
+	if filter, err := GetFilter("", ""); err != nil || filter != filters[DefaultFilter] {
+		t.Errorf("GetFilter with no name = %v, %v, want the default filter", filter, err)
+	}
+	if _, err := GetFilter("cubic", ""); err == nil {
+		t.Error("GetFilter of an unknown name succeeded")
+	}
+}
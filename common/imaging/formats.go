@@ -0,0 +1,234 @@
+package imaging
+
+import (
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// OutputSpec selects the format of the processed image and its encoder options.
+type OutputSpec struct {
+	Format string `json:"format,omitempty"`
+	// Quality of JPEG images, 1-100
+	Quality int `json:"quality,omitempty"`
+	// Compression of PNG images: default, none, speed or best
+	Compression string `json:"compression,omitempty"`
+	// Poster encodes only the first frame of animated images
+	Poster bool `json:"poster,omitempty"`
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"":        png.DefaultCompression,
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+func (s *OutputSpec) Validate() error {
+	format, err := FormatByName(s.Format)
+	if err != nil {
+		return err
+	}
+	if s.Quality != 0 && (s.Quality < 1 || s.Quality > 100) {
+		return errs.Errorf(errs.Validation, "quality must be between 1 and 100, got %d", s.Quality)
+	}
+	if _, ok := pngCompressionLevels[s.Compression]; !ok {
+		return errs.Errorf(errs.Validation, "unknown compression %q", s.Compression)
+	}
+	// Other encoders would silently ignore them
+	if s.Quality != 0 && format.Name != "jpeg" {
+		return errs.Errorf(errs.Validation, "quality applies to jpeg only, not to %q", s.Format)
+	}
+	if s.Compression != "" && format.Name != "png" {
+		return errs.Errorf(errs.Validation, "compression applies to png only, not to %q", s.Format)
+	}
+	if format.encode == nil {
+		return errs.Errorf(errs.UnsupportedMedia, "format %q can not be used for output", s.Format)
+	}
+	return nil
+}
+
+// KeepsAnimation reports whether animated images stay animated: the output is a GIF or keeps
+// the input format, and no poster frame is requested.
+func (s *OutputSpec) KeepsAnimation() bool {
+	return s == nil || (!s.Poster && (s.Format == "" || s.Format == "gif"))
+}
+
+// Extension returns the file extension of images encoded with the spec.
+func (s *OutputSpec) Extension() string {
+	format, err := FormatByName(s.Format)
+	if err != nil {
+		return ""
+	}
+	return format.Extension
+}
+
+type ImageFormat struct {
+	Name      string
+	MimeType  string
+	Extension string
+	decode    func(r io.Reader) (image.Image, error)
+	encode    func(w io.Writer, m image.Image, spec *OutputSpec) error
+}
+
+var imageFormats = []*ImageFormat{
+	{
+		Name: "jpeg", MimeType: "image/jpeg", Extension: ".jpg",
+		decode: jpeg.Decode,
+		encode: func(w io.Writer, m image.Image, spec *OutputSpec) error {
+			options := &jpeg.Options{Quality: jpeg.DefaultQuality}
+			if spec != nil && spec.Quality > 0 {
+				options.Quality = spec.Quality
+			}
+			return jpeg.Encode(w, m, options)
+		},
+	},
+	{
+		Name: "png", MimeType: "image/png", Extension: ".png",
+		decode: png.Decode,
+		encode: func(w io.Writer, m image.Image, spec *OutputSpec) error {
+			encoder := png.Encoder{}
+			if spec != nil {
+				encoder.CompressionLevel = pngCompressionLevels[spec.Compression]
+			}
+			return encoder.Encode(w, m)
+		},
+	},
+	{
+		Name: "gif", MimeType: "image/gif", Extension: ".gif",
+		decode: gif.Decode,
+		encode: func(w io.Writer, m image.Image, _ *OutputSpec) error { return gif.Encode(w, m, nil) },
+	},
+	{
+		Name: "bmp", MimeType: "image/bmp", Extension: ".bmp",
+		decode: bmp.Decode,
+		encode: func(w io.Writer, m image.Image, _ *OutputSpec) error { return bmp.Encode(w, m) },
+	},
+	{
+		Name: "tiff", MimeType: "image/tiff", Extension: ".tiff",
+		decode: tiff.Decode,
+		encode: func(w io.Writer, m image.Image, _ *OutputSpec) error { return tiff.Encode(w, m, nil) },
+	},
+	{
+		Name: "webp", MimeType: "image/webp", Extension: ".webp",
+		decode: webp.Decode,
+		// Lossless VP8L, the only mode supported by the pure-Go encoder
+		encode: func(w io.Writer, m image.Image, _ *OutputSpec) error { return nativewebp.Encode(w, m, nil) },
+	},
+}
+
+func (f *ImageFormat) Decode(r io.Reader) (image.Image, error) {
+	return f.decode(r)
+}
+
+func (f *ImageFormat) Encode(w io.Writer, m image.Image, spec *OutputSpec) error {
+	return f.encode(w, m, spec)
+}
+
+var mimeTypeAliases = map[string]string{
+	"image/jpg":      "image/jpeg",
+	"image/x-ms-bmp": "image/bmp",
+	"image/tif":      "image/tiff",
+}
+
+var extensionAliases = map[string]string{
+	".jpeg": ".jpg",
+	".jpe":  ".jpg",
+	".tif":  ".tiff",
+}
+
+func FormatByName(name string) (*ImageFormat, error) {
+	for _, format := range imageFormats {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+	return nil, errs.Errorf(errs.UnsupportedMedia, "unsupported format %q", name)
+}
+
+func FormatByMimeType(mimeType string) (*ImageFormat, error) {
+	if alias, ok := mimeTypeAliases[mimeType]; ok {
+		mimeType = alias
+	}
+	for _, format := range imageFormats {
+		if format.MimeType == mimeType {
+			return format, nil
+		}
+	}
+	return nil, errs.Errorf(errs.UnsupportedMedia, "unsupported MIME type %q", mimeType)
+}
+
+func FormatByExtension(ext string) (*ImageFormat, error) {
+	ext = strings.ToLower(ext)
+	if alias, ok := extensionAliases[ext]; ok {
+		ext = alias
+	}
+	for _, format := range imageFormats {
+		if format.Extension == ext {
+			return format, nil
+		}
+	}
+	return nil, errs.Errorf(errs.UnsupportedMedia, "unsupported extension %q", ext)
+}
+
+// DetectFormat recognizes the format of the image by its magic bytes and reads its dimensions
+// without decoding the pixels.
+func DetectFormat(r io.Reader) (*ImageFormat, image.Config, error) {
+	config, name, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, image.Config{}, errs.Errorf(errs.UnsupportedMedia, "not a supported image: %s", err)
+	}
+	format, err := FormatByName(name)
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+	return format, config, nil
+}
+
+// ColorModelName returns a short name of the color model of decoded images, e.g. "ycbcr" for most JPEGs.
+func ColorModelName(model color.Model) string {
+	switch model {
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel, color.Alpha16Model:
+		return "alpha"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.NYCbCrAModel:
+		return "nycbcra"
+	case color.CMYKModel:
+		return "cmyk"
+	}
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+	return "unknown"
+}
+
+// OutputFormat returns the format requested by the spec, or the input format if none is requested.
+func OutputFormat(input *ImageFormat, spec *OutputSpec) (*ImageFormat, error) {
+	if spec == nil || spec.Format == "" {
+		return input, nil
+	}
+	return FormatByName(spec.Format)
+}
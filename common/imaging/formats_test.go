@@ -0,0 +1,36 @@
+package imaging
+
+import (
+	"github.com/ojgenbar/Colossus/common/errs"
+	"testing"
+)
+
+func TestOutputSpecValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec OutputSpec
+		want errs.Kind
+	}{
+		{"jpeg with quality", OutputSpec{Format: "jpeg", Quality: 80}, ""},
+		{"png with compression", OutputSpec{Format: "png", Compression: "best"}, ""},
+		{"webp", OutputSpec{Format: "webp"}, ""},
+		{"quality out of range", OutputSpec{Format: "jpeg", Quality: 101}, errs.Validation},
+		{"quality of webp", OutputSpec{Format: "webp", Quality: 80}, errs.Validation},
+		{"quality of png", OutputSpec{Format: "png", Quality: 80}, errs.Validation},
+		{"quality of gif", OutputSpec{Format: "gif", Quality: 80}, errs.Validation},
+		{"compression of jpeg", OutputSpec{Format: "jpeg", Compression: "best"}, errs.Validation},
+		{"unknown compression", OutputSpec{Format: "png", Compression: "max"}, errs.Validation},
+		{"unknown format", OutputSpec{Format: "avif"}, errs.UnsupportedMedia},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("%+v: %s", tt.spec, err)
+			case tt.want != "" && !errs.Is(err, tt.want):
+				t.Errorf("%+v: %v, want %s", tt.spec, err, tt.want)
+			}
+		})
+	}
+}
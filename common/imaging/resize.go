@@ -0,0 +1,230 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type ResizeMode string
+
+const (
+	// ResizeModeFit scales the image to fit inside the box keeping the aspect ratio.
+	ResizeModeFit ResizeMode = "fit"
+	// ResizeModeFill scales the image to cover the box and crops the center. Without upscaling a box
+	// larger than the image gets the largest center crop of the image with the aspect ratio of the box.
+	ResizeModeFill ResizeMode = "fill"
+	// ResizeModeStretch scales the image to the box ignoring the aspect ratio.
+	ResizeModeStretch ResizeMode = "stretch"
+	// ResizeModePad fits the image inside the box and pads the rest with the background color.
+	ResizeModePad ResizeMode = "pad"
+)
+
+const MaxResizeDimension = 10000
+
+// ResizeSpec describes the size of the processed image.
+type ResizeSpec struct {
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Mode       ResizeMode `json:"mode"`
+	Background string     `json:"background,omitempty"`
+	Upscale    bool       `json:"upscale"`
+}
+
+func (s *ResizeSpec) Validate() error {
+	switch s.Mode {
+	case ResizeModeFit, ResizeModeStretch:
+		if s.Width <= 0 && s.Height <= 0 {
+			return errs.Errorf(errs.Validation, "mode %q requires width or height", s.Mode)
+		}
+	case ResizeModeFill, ResizeModePad:
+		if s.Width <= 0 || s.Height <= 0 {
+			return errs.Errorf(errs.Validation, "mode %q requires both width and height", s.Mode)
+		}
+	default:
+		return errs.Errorf(errs.Validation, "unknown resize mode %q", s.Mode)
+	}
+	if s.Width < 0 || s.Height < 0 || s.Width > MaxResizeDimension || s.Height > MaxResizeDimension {
+		return errs.Errorf(errs.Validation, "width and height must be between 0 and %d", MaxResizeDimension)
+	}
+	if s.Background != "" {
+		if _, err := ParseColor(s.Background); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseColor parses colors in #rrggbb or #rrggbbaa notation.
+func ParseColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, errs.Errorf(errs.Validation, "invalid color %q, expected #rrggbb or #rrggbbaa", value)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errs.Errorf(errs.Validation, "invalid color %q, expected #rrggbb or #rrggbbaa", value)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// resizePlan tells which part of the source goes to which part of the destination canvas.
+type resizePlan struct {
+	canvas     image.Rectangle
+	dst        image.Rectangle
+	src        image.Rectangle
+	background color.Color
+}
+
+// factorPlan is the legacy plan: both dimensions are divided by k.
+func factorPlan(src image.Rectangle, k int) resizePlan {
+	canvas := image.Rect(0, 0, src.Dx()/k, src.Dy()/k)
+	return resizePlan{canvas: canvas, dst: canvas, src: src}
+}
+
+// plan returns the resize plan of the source bounds in the mode of the spec. Without upscaling
+// the image is never enlarged: fit and pad keep its size, fill crops the largest part of it with
+// the aspect ratio of the box and stretch limits each dimension to the one of the image.
+func (s *ResizeSpec) plan(src image.Rectangle) (resizePlan, error) {
+	sw, sh := float64(src.Dx()), float64(src.Dy())
+	if sw == 0 || sh == 0 {
+		return resizePlan{}, errors.New("empty source image")
+	}
+	w, h := float64(s.Width), float64(s.Height)
+
+	switch s.Mode {
+	case ResizeModeFit, ResizeModePad:
+		scale := s.limitScale(fitScale(sw, sh, w, h))
+		size := image.Rect(0, 0, scaled(sw, scale), scaled(sh, scale))
+		if s.Mode == ResizeModeFit {
+			return resizePlan{canvas: size, dst: size, src: src}, nil
+		}
+		background := color.Color(color.White)
+		if s.Background != "" {
+			c, err := ParseColor(s.Background)
+			if err != nil {
+				return resizePlan{}, err
+			}
+			background = c
+		}
+		canvas := image.Rect(0, 0, s.Width, s.Height)
+		offset := image.Pt((s.Width-size.Dx())/2, (s.Height-size.Dy())/2)
+		return resizePlan{canvas: canvas, dst: size.Add(offset), src: src, background: background}, nil
+
+	case ResizeModeFill:
+		scale := math.Max(w/sw, h/sh)
+		canvas := image.Rect(0, 0, s.Width, s.Height)
+		if !s.Upscale && scale > 1 {
+			// Keep the source scale, cropping the largest part of it with the aspect ratio of the box
+			canvas = image.Rect(0, 0, scaled(w, 1/scale), scaled(h, 1/scale))
+			scale = 1
+		}
+		// Crop the center of the source with the aspect ratio of the canvas
+		cropW := min(int(math.Round(float64(canvas.Dx())/scale)), src.Dx())
+		cropH := min(int(math.Round(float64(canvas.Dy())/scale)), src.Dy())
+		crop := image.Rect(0, 0, cropW, cropH).Add(src.Min).Add(image.Pt((src.Dx()-cropW)/2, (src.Dy()-cropH)/2))
+		return resizePlan{canvas: canvas, dst: canvas, src: crop}, nil
+
+	case ResizeModeStretch:
+		width, height := s.Width, s.Height
+		if width <= 0 {
+			width = src.Dx()
+		}
+		if height <= 0 {
+			height = src.Dy()
+		}
+		if !s.Upscale {
+			width, height = min(width, src.Dx()), min(height, src.Dy())
+		}
+		canvas := image.Rect(0, 0, width, height)
+		return resizePlan{canvas: canvas, dst: canvas, src: src}, nil
+	}
+	return resizePlan{}, fmt.Errorf("unknown resize mode %q", s.Mode)
+}
+
+func (s *ResizeSpec) limitScale(scale float64) float64 {
+	if !s.Upscale && scale > 1 {
+		return 1
+	}
+	return scale
+}
+
+// fitScale returns the scale to fit (sw, sh) into (w, h). Zero w or h is not a constraint.
+func fitScale(sw, sh, w, h float64) float64 {
+	switch {
+	case w <= 0:
+		return h / sh
+	case h <= 0:
+		return w / sw
+	default:
+		return math.Min(w/sw, h/sh)
+	}
+}
+
+func scaled(v float64, scale float64) int {
+	return max(1, int(math.Round(v*scale)))
+}
+
+// Options describe how an image is converted.
+type Options struct {
+	// Resize is nil for legacy tasks, which divide both dimensions by K
+	Resize *ResizeSpec
+	K      int
+	Filter draw.Interpolator
+	Output *OutputSpec
+}
+
+// plan returns the resize plan of the source bounds, the legacy one if no size is requested.
+func (o Options) plan(src image.Rectangle) (resizePlan, error) {
+	if o.Resize != nil {
+		return o.Resize.plan(src)
+	}
+	return factorPlan(src, o.K), nil
+}
+
+// OutputBounds returns the bounds of the image Convert makes of a source with the bounds src.
+func (o Options) OutputBounds(src image.Rectangle) (image.Rectangle, error) {
+	plan, err := o.plan(src)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return plan.canvas, nil
+}
+
+// Convert resizes the decoded image and encodes it in the output format.
+func Convert(src image.Image, output io.Writer, outFormat *ImageFormat, options Options) (image.Rectangle, error) {
+	// Set the expected size that you want:
+	plan, err := options.plan(src.Bounds())
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+
+	// Resize:
+	dst := resize(src, plan, options.Filter)
+
+	// Encode to `output`:
+	err = outFormat.Encode(output, dst, options.Output)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return dst.Rect, nil
+}
+
+func resize(src image.Image, plan resizePlan, filter draw.Interpolator) *image.RGBA {
+	dst := image.NewRGBA(plan.canvas)
+	if plan.background != nil {
+		draw.Draw(dst, dst.Rect, image.NewUniform(plan.background), image.Point{}, draw.Src)
+	}
+	filter.Scale(dst, plan.dst, src, plan.src, draw.Over, nil)
+	return dst
+}
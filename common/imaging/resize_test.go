@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"image"
+	"testing"
+)
+
+func TestOutputBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     ResizeSpec
+		src      image.Rectangle
+		want     image.Rectangle
+		wantCrop image.Rectangle
+	}{
+		{
+			name:     "fill downscales and crops",
+			spec:     ResizeSpec{Width: 100, Height: 50, Mode: ResizeModeFill},
+			src:      image.Rect(0, 0, 400, 400),
+			want:     image.Rect(0, 0, 100, 50),
+			wantCrop: image.Rect(0, 100, 400, 300),
+		},
+		{
+			name:     "fill upscales",
+			spec:     ResizeSpec{Width: 800, Height: 600, Mode: ResizeModeFill, Upscale: true},
+			src:      image.Rect(0, 0, 400, 400),
+			want:     image.Rect(0, 0, 800, 600),
+			wantCrop: image.Rect(0, 50, 400, 350),
+		},
+		{
+			name:     "fill without upscaling keeps the aspect of a larger box",
+			spec:     ResizeSpec{Width: 800, Height: 600, Mode: ResizeModeFill},
+			src:      image.Rect(0, 0, 400, 400),
+			want:     image.Rect(0, 0, 400, 300),
+			wantCrop: image.Rect(0, 50, 400, 350),
+		},
+		{
+			name:     "fill without upscaling a box larger in one dimension",
+			spec:     ResizeSpec{Width: 300, Height: 600, Mode: ResizeModeFill},
+			src:      image.Rect(0, 0, 400, 400),
+			want:     image.Rect(0, 0, 200, 400),
+			wantCrop: image.Rect(100, 0, 300, 400),
+		},
+		{
+			name:     "fill without upscaling an offset source",
+			spec:     ResizeSpec{Width: 90, Height: 30, Mode: ResizeModeFill},
+			src:      image.Rect(10, 10, 70, 70),
+			want:     image.Rect(0, 0, 60, 20),
+			wantCrop: image.Rect(10, 30, 70, 50),
+		},
+		{
+			name:     "fit without upscaling",
+			spec:     ResizeSpec{Width: 800, Mode: ResizeModeFit},
+			src:      image.Rect(0, 0, 400, 200),
+			want:     image.Rect(0, 0, 400, 200),
+			wantCrop: image.Rect(0, 0, 400, 200),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			options := Options{Resize: &spec}
+			got, err := options.OutputBounds(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("output of %v, want %v", got, tt.want)
+			}
+			plan, err := options.plan(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.src != tt.wantCrop {
+				t.Errorf("crops %v, want %v", plan.src, tt.wantCrop)
+			}
+		})
+	}
+}
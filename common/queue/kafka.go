@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"log"
+	"sync"
+	"time"
+)
+
+// KafkaConfig holds connection settings shared by Kafka publishers and consumers.
+type KafkaConfig struct {
+	BootstrapServers string
+	ClientId         string
+	Acks             string
+	GroupId          string
+	SessionTimeoutMs int
+	AutoOffsetReset  string
+	// CommitIntervalMs is how often offsets of done messages are committed, 5s by default
+	CommitIntervalMs int
+}
+
+// KafkaPublisher publishes messages with a single long-lived producer. Delivery reports
+// are handled by a background goroutine, which resolves the Delivery of every message.
+type KafkaPublisher struct {
+	producer *kafka.Producer
+	// mu makes Close wait for Produce calls in progress
+	mu      sync.RWMutex
+	closed  bool
+	pending sync.Map
+	// done is closed once all delivery reports are handled
+	done chan struct{}
+}
+
+func NewKafkaPublisher(cfg KafkaConfig) (*KafkaPublisher, error) {
+	configMap := kafka.ConfigMap{
+		"bootstrap.servers": cfg.BootstrapServers,
+		"client.id":         cfg.ClientId,
+	}
+	if cfg.Acks != "" {
+		configMap["acks"] = cfg.Acks
+	}
+	p, err := kafka.NewProducer(&configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	kp := &KafkaPublisher{producer: p, done: make(chan struct{})}
+	go kp.handleEvents()
+	log.Printf("Created Producer %v\n", p)
+	return kp, nil
+}
+
+func (p *KafkaPublisher) handleEvents() {
+	defer close(p.done)
+	for e := range p.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			d, ok := ev.Opaque.(*Delivery)
+			if !ok {
+				continue
+			}
+			p.pending.Delete(d)
+			if ev.TopicPartition.Error != nil {
+				d.resolve(errs.Wrap(errs.QueueUnavailable, ev.TopicPartition.Error))
+				continue
+			}
+			d.msg.Partition = ev.TopicPartition.Partition
+			d.msg.Offset = int64(ev.TopicPartition.Offset)
+			d.resolve(nil)
+		case kafka.Error:
+			log.Printf("Producer error: %v: %v\n", ev.Code(), ev)
+		}
+	}
+}
+
+// PublishAsync enqueues the message without waiting for the broker. Partition and Offset
+// of the message are set once the delivery is resolved successfully.
+func (p *KafkaPublisher) PublishAsync(msg *Message) (*Delivery, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	headers := make([]kafka.Header, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers = append(headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+
+	topic := msg.Topic
+	d := &Delivery{msg: msg, done: make(chan struct{})}
+	p.pending.Store(d, struct{}{})
+	err := p.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+		Opaque:         d,
+	}, nil)
+	if err != nil {
+		p.pending.Delete(d)
+		return nil, errs.Wrap(errs.QueueUnavailable, err)
+	}
+	return d, nil
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msg *Message) error {
+	d, err := p.PublishAsync(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-d.Done():
+		return d.Err()
+	case <-ctx.Done():
+		return errs.Wrap(errs.QueueUnavailable, ctx.Err())
+	}
+}
+
+// Close flushes outstanding messages for up to 10 seconds and closes the producer.
+// Deliveries still unresolved after that fail with ErrClosed.
+func (p *KafkaPublisher) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	if remaining := p.producer.Flush(10000); remaining > 0 {
+		log.Printf("%d messages were not delivered\n", remaining)
+	}
+	p.producer.Close()
+	<-p.done
+
+	p.pending.Range(func(key, _ interface{}) bool {
+		key.(*Delivery).resolve(ErrClosed)
+		return true
+	})
+}
+
+// KafkaConsumer commits offsets of done messages only. Stored offsets are committed
+// periodically by librdkafka and before partitions are revoked.
+type KafkaConsumer struct {
+	consumer *kafka.Consumer
+	tracker  *offsetTracker
+}
+
+func NewKafkaConsumer(cfg KafkaConfig, topics []string) (*KafkaConsumer, error) {
+	commitInterval := cfg.CommitIntervalMs
+	if commitInterval <= 0 {
+		commitInterval = 5000
+	}
+	configMap := kafka.ConfigMap{
+		"bootstrap.servers":        cfg.BootstrapServers,
+		"client.id":                cfg.ClientId,
+		"group.id":                 cfg.GroupId,
+		"auto.offset.reset":        "earliest",
+		"enable.auto.commit":       true,
+		"auto.commit.interval.ms":  commitInterval,
+		"enable.auto.offset.store": false,
+		"allow.auto.create.topics": false,
+	}
+	if cfg.AutoOffsetReset != "" {
+		configMap["auto.offset.reset"] = cfg.AutoOffsetReset
+	}
+	if cfg.SessionTimeoutMs > 0 {
+		configMap["session.timeout.ms"] = cfg.SessionTimeoutMs
+	}
+	c, err := kafka.NewConsumer(&configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	kc := &KafkaConsumer{consumer: c, tracker: newOffsetTracker()}
+	err = c.SubscribeTopics(topics, func(c *kafka.Consumer, ev kafka.Event) error {
+		if e, ok := ev.(kafka.RevokedPartitions); ok {
+			// Commit what is done before partitions are handed over to another consumer
+			kc.Commit()
+			kc.tracker.Revoke(topicPartitions(e.Partitions))
+		}
+		return nil
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	log.Printf("Created Consumer %v\n", c)
+	return kc, nil
+}
+
+func (c *KafkaConsumer) Poll(timeout time.Duration) (*Message, error) {
+	ev := c.consumer.Poll(int(timeout.Milliseconds()))
+	switch e := ev.(type) {
+	case nil:
+		return nil, nil
+	case *kafka.Message:
+		tp := topicPartition{topic: *e.TopicPartition.Topic, partition: e.TopicPartition.Partition}
+		offset := int64(e.TopicPartition.Offset)
+		msg := &Message{
+			Topic:      tp.topic,
+			Partition:  tp.partition,
+			Offset:     offset,
+			Key:        e.Key,
+			Value:      e.Value,
+			generation: c.tracker.Add(tp, offset),
+		}
+		for _, h := range e.Headers {
+			msg.Headers = append(msg.Headers, Header{Key: h.Key, Value: h.Value})
+		}
+		return msg, nil
+	case kafka.Error:
+		if e.IsFatal() {
+			return nil, e
+		}
+		// Errors should generally be considered
+		// informational, the client will try to
+		// automatically recover.
+		log.Printf("Error: %v: %v\n", e.Code(), e)
+		return nil, nil
+	default:
+		log.Printf("Ignored event %v\n", e)
+		return nil, nil
+	}
+}
+
+func (c *KafkaConsumer) Done(msg *Message) {
+	c.tracker.Done(topicPartition{topic: msg.Topic, partition: msg.Partition}, msg.Offset, msg.generation)
+	c.storeOffsets()
+}
+
+// storeOffsets stores offsets of the finished prefix of every partition, to be committed later.
+func (c *KafkaConsumer) storeOffsets() {
+	committable := c.tracker.Committable()
+	if len(committable) == 0 {
+		return
+	}
+	offsets := make([]kafka.TopicPartition, 0, len(committable))
+	for _, o := range committable {
+		topic := o.topic
+		offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: o.partition, Offset: kafka.Offset(o.offset)})
+	}
+	_, err := c.consumer.StoreOffsets(offsets)
+	if err != nil {
+		log.Printf("Failed to store offsets %v: %s\n", offsets, err)
+	}
+}
+
+// Commit commits offsets stored so far. Having nothing to commit is not an error.
+func (c *KafkaConsumer) Commit() {
+	c.storeOffsets()
+	partitions, err := c.consumer.Commit()
+	if err != nil {
+		var kafkaErr kafka.Error
+		if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrNoOffset {
+			return
+		}
+		log.Printf("Failed to commit offsets: %s\n", err)
+		return
+	}
+	log.Printf("Committed offsets %v\n", partitions)
+}
+
+func (c *KafkaConsumer) InFlight() int {
+	return c.tracker.InFlight()
+}
+
+func (c *KafkaConsumer) Close() {
+	c.Commit()
+	if err := c.consumer.Close(); err != nil {
+		log.Printf("Failed to close consumer: %s\n", err)
+	}
+}
+
+func topicPartitions(partitions []kafka.TopicPartition) []topicPartition {
+	result := make([]topicPartition, 0, len(partitions))
+	for _, tp := range partitions {
+		result = append(result, topicPartition{topic: *tp.Topic, partition: tp.Partition})
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"context"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// memoryTopicCapacity is the number of messages a topic holds before Publish blocks
+// and PublishAsync fails.
+const memoryTopicCapacity = 1024
+
+// MemoryBroker passes messages between components of the same process through channels.
+// Every topic has a single partition, consumers of a topic compete for its messages.
+// Messages are lost when the process exits.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+type memoryTopic struct {
+	ch     chan *Message
+	mu     sync.Mutex
+	offset int64
+}
+
+// DefaultBroker connects publishers and consumers configured with the memory driver.
+var DefaultBroker = NewMemoryBroker()
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]*memoryTopic)}
+}
+
+func (b *MemoryBroker) topic(name string) *memoryTopic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{ch: make(chan *Message, memoryTopicCapacity)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *MemoryBroker) Publisher() AsyncPublisher {
+	return &memoryPublisher{broker: b}
+}
+
+func (b *MemoryBroker) Consumer(topics []string) Consumer {
+	c := &memoryConsumer{}
+	for _, name := range topics {
+		c.cases = append(c.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(b.topic(name).ch)})
+	}
+	return c
+}
+
+type memoryPublisher struct {
+	broker *MemoryBroker
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, msg *Message) error {
+	t, received := p.prepare(msg)
+	select {
+	case t.ch <- received:
+		msg.Offset = received.Offset
+		return nil
+	case <-ctx.Done():
+		return errs.Wrap(errs.QueueUnavailable, ctx.Err())
+	}
+}
+
+// PublishAsync hands the message to the topic at once and returns a resolved delivery. Like a full
+// Kafka producer queue, a full topic fails the message instead of blocking the caller.
+func (p *memoryPublisher) PublishAsync(msg *Message) (*Delivery, error) {
+	t, received := p.prepare(msg)
+	select {
+	case t.ch <- received:
+		msg.Offset = received.Offset
+	default:
+		return nil, errs.Errorf(errs.QueueUnavailable, "topic %q is full", msg.Topic)
+	}
+	d := &Delivery{msg: msg, done: make(chan struct{})}
+	d.resolve(nil)
+	return d, nil
+}
+
+// prepare copies the message as the consumer receives it.
+func (p *memoryPublisher) prepare(msg *Message) (*memoryTopic, *Message) {
+	t := p.broker.topic(msg.Topic)
+
+	t.mu.Lock()
+	received := *msg
+	received.Offset = t.offset
+	t.offset++
+	t.mu.Unlock()
+	received.Headers = append([]Header(nil), msg.Headers...)
+	return t, &received
+}
+
+func (p *memoryPublisher) Close() {}
+
+type memoryConsumer struct {
+	cases    []reflect.SelectCase
+	inFlight int
+}
+
+func (c *memoryConsumer) Poll(timeout time.Duration) (*Message, error) {
+	if len(c.cases) == 0 {
+		time.Sleep(timeout)
+		return nil, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	cases := append(c.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	chosen, value, ok := reflect.Select(cases)
+	if chosen == len(c.cases) {
+		return nil, nil
+	}
+	if !ok {
+		return nil, ErrClosed
+	}
+	c.inFlight++
+	return value.Interface().(*Message), nil
+}
+
+// Done forgets the message, messages taken from a channel are never redelivered.
+func (c *memoryConsumer) Done(_ *Message) {
+	c.inFlight--
+}
+
+func (c *memoryConsumer) Commit() {}
+
+func (c *memoryConsumer) InFlight() int {
+	return c.inFlight
+}
+
+func (c *memoryConsumer) Close() {}
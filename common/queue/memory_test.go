@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"context"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"testing"
+	"time"
+)
+
+func TestMemoryPublishAsyncFullTopic(t *testing.T) {
+	broker := NewMemoryBroker()
+	publisher := broker.Publisher()
+	for i := range memoryTopicCapacity {
+		d, err := publisher.PublishAsync(&Message{Topic: "tasks", Value: []byte{byte(i)}})
+		if err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		<-d.Done()
+		if d.Err() != nil {
+			t.Fatalf("message %d: %s", i, d.Err())
+		}
+	}
+
+	_, err := publisher.PublishAsync(&Message{Topic: "tasks"})
+	if !errs.Is(err, errs.QueueUnavailable) {
+		t.Fatalf("publishing to a full topic: %v, want %s", err, errs.QueueUnavailable)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := publisher.Publish(ctx, &Message{Topic: "tasks"}); !errs.Is(err, errs.QueueUnavailable) {
+		t.Fatalf("publishing to a full topic until canceled: %v, want %s", err, errs.QueueUnavailable)
+	}
+
+	consumer := broker.Consumer([]string{"tasks"})
+	msg, err := consumer.Poll(time.Second)
+	if err != nil || msg == nil || msg.Value[0] != 0 {
+		t.Fatalf("polled %+v, %v, want the first message", msg, err)
+	}
+	consumer.Done(msg)
+	if _, err := publisher.PublishAsync(&Message{Topic: "tasks"}); err != nil {
+		t.Fatalf("publishing after a message was consumed: %s", err)
+	}
+}
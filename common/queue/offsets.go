@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"sort"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets tracks in-flight offsets of a single partition.
+type partitionOffsets struct {
+	generation int
+	pending    []int64
+	done       map[int64]bool
+}
+
+// committedOffset is the next offset to consume from the partition.
+type committedOffset struct {
+	topicPartition
+	offset int64
+}
+
+// offsetTracker finds offsets safe to commit: only the contiguous prefix
+// of finished messages of every partition may be committed.
+type offsetTracker struct {
+	partitions map[topicPartition]*partitionOffsets
+	generation int
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+}
+
+// Add registers a received message and returns the generation of its partition.
+func (t *offsetTracker) Add(tp topicPartition, offset int64) int {
+	p, ok := t.partitions[tp]
+	if !ok {
+		t.generation++
+		p = &partitionOffsets{
+			generation: t.generation,
+			done:       make(map[int64]bool),
+		}
+		t.partitions[tp] = p
+	}
+	p.pending = append(p.pending, offset)
+	return p.generation
+}
+
+// Done marks the message as finished. Messages of revoked partitions are ignored.
+func (t *offsetTracker) Done(tp topicPartition, offset int64, generation int) {
+	p, ok := t.partitions[tp]
+	if !ok || p.generation != generation {
+		return
+	}
+	p.done[offset] = true
+}
+
+// Committable returns the next offset to commit for every partition
+// which has advanced since the last call.
+func (t *offsetTracker) Committable() []committedOffset {
+	var result []committedOffset
+	for tp, p := range t.partitions {
+		advanced := false
+		var last int64
+		for len(p.pending) > 0 && p.done[p.pending[0]] {
+			last = p.pending[0]
+			advanced = true
+			delete(p.done, last)
+			p.pending = p.pending[1:]
+		}
+		if !advanced {
+			continue
+		}
+		result = append(result, committedOffset{topicPartition: tp, offset: last + 1})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].topic != result[j].topic {
+			return result[i].topic < result[j].topic
+		}
+		return result[i].partition < result[j].partition
+	})
+	return result
+}
+
+// Revoke forgets the partitions. Messages still in flight for them will be redelivered
+// to the new owner, because their offsets were never committed.
+func (t *offsetTracker) Revoke(partitions []topicPartition) {
+	for _, tp := range partitions {
+		delete(t.partitions, tp)
+	}
+}
+
+// InFlight returns the number of messages received but not committable yet.
+func (t *offsetTracker) InFlight() int {
+	n := 0
+	for _, p := range t.partitions {
+		n += len(p.pending)
+	}
+	return n
+}
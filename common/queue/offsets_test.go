@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"slices"
+	"testing"
+)
+
+// offsetStep is an operation on the tracker. Generations are numbered from 1 in order
+// partitions are first added, or added again after a revoke.
+type offsetStep struct {
+	op         string
+	tp         topicPartition
+	offset     int64
+	generation int
+	// want is the result of a commit
+	want []committedOffset
+}
+
+var (
+	tasks0 = topicPartition{topic: "tasks", partition: 0}
+	tasks1 = topicPartition{topic: "tasks", partition: 1}
+	events = topicPartition{topic: "events", partition: 0}
+)
+
+func add(tp topicPartition, offset int64, generation int) offsetStep {
+	return offsetStep{op: "add", tp: tp, offset: offset, generation: generation}
+}
+
+func done(tp topicPartition, offset int64, generation int) offsetStep {
+	return offsetStep{op: "done", tp: tp, offset: offset, generation: generation}
+}
+
+func revoke(tp topicPartition) offsetStep {
+	return offsetStep{op: "revoke", tp: tp}
+}
+
+func commit(want ...committedOffset) offsetStep {
+	return offsetStep{op: "commit", want: want}
+}
+
+func at(tp topicPartition, offset int64) committedOffset {
+	return committedOffset{topicPartition: tp, offset: offset}
+}
+
+func TestOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name         string
+		steps        []offsetStep
+		wantInFlight int
+	}{
+		{
+			name: "in order",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1), add(tasks0, 2, 1),
+				done(tasks0, 0, 1), done(tasks0, 1, 1), commit(at(tasks0, 2)),
+				done(tasks0, 2, 1), commit(at(tasks0, 3)),
+				commit(),
+			},
+		},
+		{
+			name: "out of order completion",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1), add(tasks0, 2, 1),
+				done(tasks0, 2, 1), done(tasks0, 1, 1), commit(),
+				done(tasks0, 0, 1), commit(at(tasks0, 3)),
+			},
+		},
+		{
+			name: "unfinished message holds back later ones",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1), add(tasks0, 2, 1), add(tasks0, 3, 1),
+				done(tasks0, 0, 1), done(tasks0, 2, 1), done(tasks0, 3, 1), commit(at(tasks0, 1)),
+				commit(),
+			},
+			wantInFlight: 3,
+		},
+		{
+			name: "gaps between offsets",
+			steps: []offsetStep{
+				add(tasks0, 5, 1), add(tasks0, 8, 1), add(tasks0, 12, 1),
+				done(tasks0, 5, 1), done(tasks0, 12, 1), commit(at(tasks0, 6)),
+				done(tasks0, 8, 1), commit(at(tasks0, 13)),
+			},
+		},
+		{
+			name: "partitions advance independently",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1), add(tasks1, 0, 2),
+				done(tasks1, 0, 2), done(tasks0, 1, 1), commit(at(tasks1, 1)),
+				done(tasks0, 0, 1), commit(at(tasks0, 2)),
+			},
+		},
+		{
+			name: "commits are sorted",
+			steps: []offsetStep{
+				add(tasks1, 0, 1), add(tasks0, 0, 2), add(events, 0, 3),
+				done(tasks1, 0, 1), done(tasks0, 0, 2), done(events, 0, 3),
+				commit(at(events, 1), at(tasks0, 1), at(tasks1, 1)),
+			},
+		},
+		{
+			name: "done twice",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), done(tasks0, 0, 1), done(tasks0, 0, 1), commit(at(tasks0, 1)),
+				commit(),
+			},
+		},
+		{
+			name: "revoked partition is not committed",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1), done(tasks0, 0, 1),
+				revoke(tasks0), commit(),
+			},
+		},
+		{
+			name: "revoke keeps other partitions",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks1, 0, 2),
+				revoke(tasks0), done(tasks1, 0, 2), commit(at(tasks1, 1)),
+			},
+		},
+		{
+			name: "reassigned partition ignores done of the revoked assignment",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks0, 1, 1),
+				revoke(tasks0),
+				// Redelivered after the partition is assigned again
+				add(tasks0, 0, 2), add(tasks0, 1, 2),
+				done(tasks0, 0, 1), done(tasks0, 1, 1), commit(),
+				done(tasks0, 0, 2), commit(at(tasks0, 1)),
+				done(tasks0, 1, 2), commit(at(tasks0, 2)),
+			},
+		},
+		{
+			name: "stale generation of another partition",
+			steps: []offsetStep{
+				add(tasks0, 0, 1), add(tasks1, 0, 2),
+				done(tasks1, 0, 1), commit(),
+			},
+			wantInFlight: 2,
+		},
+		{
+			name: "done of an unknown partition",
+			steps: []offsetStep{
+				done(tasks0, 0, 1), commit(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker()
+			for i, step := range tt.steps {
+				switch step.op {
+				case "add":
+					if generation := tracker.Add(step.tp, step.offset); generation != step.generation {
+						t.Fatalf("step %d: added to generation %d, want %d", i, generation, step.generation)
+					}
+				case "done":
+					tracker.Done(step.tp, step.offset, step.generation)
+				case "revoke":
+					tracker.Revoke([]topicPartition{step.tp})
+				case "commit":
+					if got := tracker.Committable(); !slices.Equal(got, step.want) {
+						t.Fatalf("step %d: committable %v, want %v", i, got, step.want)
+					}
+				}
+			}
+			if got := tracker.InFlight(); got != tt.wantInFlight {
+				t.Errorf("%d messages in flight, want %d", got, tt.wantInFlight)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Package queue abstracts the message broker connecting the backend and the converter.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"time"
+)
+
+const (
+	DriverKafka  = "kafka"
+	DriverMemory = "memory"
+)
+
+var ErrClosed = errs.New(errs.QueueUnavailable, "queue is closed")
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is a message published to or received from a topic.
+// Partition and Offset are set for received messages only.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+
+	// generation of the partition assignment the message was received under
+	generation int
+}
+
+// Publisher sends messages to topics. It is safe for concurrent use.
+type Publisher interface {
+	// Publish returns once the broker has accepted the message.
+	Publish(ctx context.Context, msg *Message) error
+	// Close waits for outstanding messages to be delivered.
+	Close()
+}
+
+// AsyncPublisher pipelines messages: PublishAsync returns without waiting for the broker,
+// the returned Delivery is resolved once the broker accepts the message or fails to.
+type AsyncPublisher interface {
+	Publisher
+	PublishAsync(msg *Message) (*Delivery, error)
+}
+
+// Delivery is resolved once the broker acknowledges the message or fails to.
+type Delivery struct {
+	msg  *Message
+	done chan struct{}
+	err  error
+}
+
+// Done is closed when the delivery is resolved.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the delivery error. It must be called after Done is closed.
+func (d *Delivery) Err() error {
+	return d.err
+}
+
+func (d *Delivery) resolve(err error) {
+	d.err = err
+	close(d.done)
+}
+
+// Consumer receives messages of the subscribed topics at least once: a message is
+// redelivered, possibly to another consumer, unless it is marked done.
+// It is not safe for concurrent use.
+type Consumer interface {
+	// Poll waits up to the timeout for the next message. It returns nil if none arrived.
+	Poll(timeout time.Duration) (*Message, error)
+	// Done marks the message as processed. Offsets are committed in order, so a message
+	// is committed only once all messages received before it from the same partition are done.
+	Done(msg *Message)
+	// Commit commits messages done so far.
+	Commit()
+	// InFlight returns the number of received messages not committable yet.
+	InFlight() int
+	// Close commits messages done so far and leaves the group.
+	Close()
+}
+
+// Client creates publishers and consumers of the broker selected by the driver.
+type Client struct {
+	driver string
+	kafka  KafkaConfig
+}
+
+// New returns the client of the broker selected by cfg.Driver, Kafka by default.
+func New(cfg *config.Queue, kafka KafkaConfig) (*Client, error) {
+	switch cfg.Driver {
+	case DriverKafka, "", DriverMemory:
+		return &Client{driver: cfg.Driver, kafka: kafka}, nil
+	default:
+		return nil, fmt.Errorf("unknown queue driver %q", cfg.Driver)
+	}
+}
+
+func (c *Client) Publisher() (AsyncPublisher, error) {
+	if c.driver == DriverMemory {
+		return DefaultBroker.Publisher(), nil
+	}
+	return NewKafkaPublisher(c.kafka)
+}
+
+// Consumer subscribes to the topics. A non-empty groupId overrides the group of the Kafka config.
+func (c *Client) Consumer(groupId string, topics []string) (Consumer, error) {
+	if c.driver == DriverMemory {
+		return DefaultBroker.Consumer(topics), nil
+	}
+	kafka := c.kafka
+	if groupId != "" {
+		kafka.GroupId = groupId
+	}
+	return NewKafkaConsumer(kafka, topics)
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"io"
+	"io/fs"
+	"iter"
+	"mime"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// metaDir keeps content types and metadata of objects, mirroring the bucket's layout.
+const metaDir = ".meta"
+
+// LocalStore keeps objects as files under <root>/<bucket>/<key>. Useful to run
+// everything on one box without MinIO and in tests.
+type LocalStore struct {
+	root string
+}
+
+type localMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, errors.New("local storage requires root directory")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+// paths returns locations of the object and of its metadata.
+func (s *LocalStore) paths(bucket string, key string) (string, string, error) {
+	if !filepath.IsLocal(bucket) || strings.ContainsRune(bucket, '/') || bucket == metaDir {
+		return "", "", errs.Errorf(errs.Validation, "invalid bucket %q", bucket)
+	}
+	if !filepath.IsLocal(key) || strings.HasSuffix(key, "/") {
+		return "", "", errs.Errorf(errs.Validation, "invalid key %q", key)
+	}
+	object := filepath.Join(s.root, bucket, filepath.FromSlash(key))
+	meta := filepath.Join(s.root, metaDir, bucket, filepath.FromSlash(key)+".json")
+	return object, meta, nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, bucket string, key string, r io.Reader, _ int64, opts PutOptions) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	objectPath, metaPath, err := s.paths(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err = os.Stat(filepath.Join(s.root, bucket)); err != nil {
+		return ObjectInfo{}, fmt.Errorf("bucket %q: %w", bucket, err)
+	}
+
+	hash := md5.New()
+	err = writeFileAtomic(objectPath, io.TeeReader(r, hash))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	meta := localMeta{ContentType: opts.ContentType, Metadata: canonicalMetadata(opts.Metadata)}
+	b, err := json.Marshal(&meta)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	err = writeFileAtomic(metaPath, strings.NewReader(string(b)))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := s.Stat(ctx, bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.ETag = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, bucket, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	objectPath, _, _ := s.paths(bucket, key)
+	f, err := os.Open(objectPath)
+	if err != nil {
+		return nil, ObjectInfo{}, localError(err)
+	}
+	return f, info, nil
+}
+
+func (s *LocalStore) Stat(_ context.Context, bucket string, key string) (ObjectInfo, error) {
+	objectPath, metaPath, err := s.paths(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(objectPath)
+	if err != nil {
+		return ObjectInfo{}, localError(err)
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+	}
+
+	var meta localMeta
+	if b, err := os.ReadFile(metaPath); err == nil {
+		_ = json.Unmarshal(b, &meta)
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	return ObjectInfo{
+		Bucket:       bucket,
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  meta.ContentType,
+		LastModified: fi.ModTime().UTC(),
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+func (s *LocalStore) Delete(_ context.Context, bucket string, key string) error {
+	objectPath, metaPath, err := s.paths(bucket, key)
+	if err != nil {
+		return err
+	}
+	// Deleting a missing object is not an error, like in S3.
+	if err = os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err = os.Remove(metaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List yields the objects sorted by key like in S3. WalkDir orders paths, not keys: "a/b" comes
+// before "a-b" there, so keys are collected and sorted first.
+func (s *LocalStore) List(ctx context.Context, bucket string, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		bucketPath := filepath.Join(s.root, bucket)
+		var keys []string
+		err := filepath.WalkDir(bucketPath, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+				return nil
+			}
+			rel, err := filepath.Rel(bucketPath, p)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+
+		slices.Sort(keys)
+		for _, key := range keys {
+			info, err := s.Stat(ctx, bucket, key)
+			if errors.Is(err, ErrNotFound) {
+				// Removed since the walk
+				continue
+			}
+			if !yield(info, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Presign returns a file:// URL, local objects need no credentials.
+func (s *LocalStore) Presign(ctx context.Context, bucket string, key string, _ time.Duration) (string, error) {
+	if _, err := s.Stat(ctx, bucket, key); err != nil {
+		return "", err
+	}
+	objectPath, _, _ := s.paths(bucket, key)
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(objectPath)}).String(), nil
+}
+
+func (s *LocalStore) MakeBucket(_ context.Context, bucket config.S3Bucket) error {
+	if _, _, err := s.paths(bucket.Name, "probe"); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(s.root, bucket.Name), 0o755)
+}
+
+// Ping checks that the root directory exists.
+func (s *LocalStore) Ping(_ context.Context) error {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.root)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file next to its destination and renames it, so readers
+// never see a partially written object.
+func writeFileAtomic(name string, r io.Reader) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// canonicalMetadata formats keys the way S3 returns them, e.g. "width" becomes "Width".
+func canonicalMetadata(metadata map[string]string) map[string]string {
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return result
+}
+
+func localError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
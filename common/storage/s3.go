@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"io"
+	"iter"
+	"log"
+	"time"
+)
+
+func NewS3Client(s3cfg *config.S3) (*minio.Client, error) {
+	endpoint := s3cfg.Auth.Endpoint
+	accessKeyID := s3cfg.Auth.AccessKeyID
+	secretAccessKey := s3cfg.Auth.SecretAccessKey
+
+	// Initialize minio client object.
+	return minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		//Secure: useSSL,
+	})
+}
+
+// S3Store keeps objects in MinIO or any other S3 compatible storage.
+type S3Store struct {
+	client *minio.Client
+}
+
+func NewS3Store(s3cfg *config.S3) (*S3Store, error) {
+	client, err := NewS3Client(s3cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{client: client}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	info, err := s.client.PutObject(ctx, bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:  opts.ContentType,
+		UserMetadata: opts.Metadata,
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{
+		Bucket:       info.Bucket,
+		Key:          info.Key,
+		ETag:         info.ETag,
+		Size:         info.Size,
+		ContentType:  opts.ContentType,
+		LastModified: info.LastModified,
+		Metadata:     opts.Metadata,
+	}, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, ObjectInfo, error) {
+	object, err := s.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	// GetObject is lazy, Stat makes the request.
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	return object, objectInfo(bucket, info), nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return objectInfo(bucket, info), nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, bucket string, key string) error {
+	return s3Error(s.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Store) List(ctx context.Context, bucket string, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		for info := range s.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if info.Err != nil {
+				yield(ObjectInfo{}, s3Error(info.Err))
+				return
+			}
+			if !yield(objectInfo(bucket, info), nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *S3Store) Presign(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, bucket, key, expires, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Ping lists buckets. Any response of the server, even an error one, means it is reachable.
+func (s *S3Store) Ping(ctx context.Context) error {
+	_, err := s.client.ListBuckets(ctx)
+	if err != nil && minio.ToErrorResponse(err).Code == "" {
+		return errs.Wrap(errs.StorageUnavailable, err)
+	}
+	return nil
+}
+
+func (s *S3Store) MakeBucket(ctx context.Context, bucket config.S3Bucket) error {
+	err := s.client.MakeBucket(ctx, bucket.Name, minio.MakeBucketOptions{Region: bucket.Location})
+	if err != nil {
+		// Check to see if we already own this bucket (which happens if you run this twice)
+		exists, errBucketExists := s.client.BucketExists(ctx, bucket.Name)
+		if errBucketExists == nil && exists {
+			log.Printf("We already own %s\n", bucket.Name)
+			return nil
+		}
+		return err
+	}
+	log.Printf("Successfully created %s\n", bucket.Name)
+	return nil
+}
+
+func objectInfo(bucket string, info minio.ObjectInfo) ObjectInfo {
+	metadata := make(map[string]string, len(info.UserMetadata))
+	for k, v := range info.UserMetadata {
+		metadata[k] = v
+	}
+	return ObjectInfo{
+		Bucket:       bucket,
+		Key:          info.Key,
+		ETag:         info.ETag,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Metadata:     metadata,
+	}
+}
+
+// s3Error classifies errors of the client. Errors without a response of the server
+// mean the storage could not be reached.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey":
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case "":
+		return errs.Wrap(errs.StorageUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+// Package storage abstracts the object storage used for raw and processed images.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"io"
+	"iter"
+	"time"
+)
+
+var ErrNotFound = errs.New(errs.NotFound, "object not found")
+
+// Metadata keys holding the dimensions of stored images
+const (
+	MetadataWidth  = "Width"
+	MetadataHeight = "Height"
+)
+
+// ObjectInfo describes a stored object. Metadata keys are canonical, e.g. MetadataWidth.
+type ObjectInfo struct {
+	Bucket       string
+	Key          string
+	ETag         string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+type PutOptions struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// ObjectStore is implemented by every storage driver. Missing objects are reported with ErrNotFound.
+type ObjectStore interface {
+	Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error)
+	// Get returns the object's content, the caller must close it.
+	Get(ctx context.Context, bucket string, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, bucket string, key string) error
+	// List yields objects whose keys start with the prefix, in lexical order.
+	List(ctx context.Context, bucket string, prefix string) iter.Seq2[ObjectInfo, error]
+	// Presign returns a URL the object may be downloaded from without credentials.
+	Presign(ctx context.Context, bucket string, key string, expires time.Duration) (string, error)
+	// MakeBucket creates the bucket unless it already exists.
+	MakeBucket(ctx context.Context, bucket config.S3Bucket) error
+	// Ping checks that the storage is reachable.
+	Ping(ctx context.Context) error
+}
+
+const (
+	DriverS3    = "s3"
+	DriverLocal = "local"
+)
+
+// New returns the store selected by cfg.Driver, S3 by default.
+func New(cfg *config.Storage, s3cfg *config.S3) (ObjectStore, error) {
+	switch cfg.Driver {
+	case DriverS3, "":
+		return NewS3Store(s3cfg)
+	case DriverLocal:
+		return NewLocalStore(cfg.Root)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
@@ -0,0 +1,109 @@
+// Package tasks defines messages exchanged by the backend and the converter through Kafka.
+package tasks
+
+import (
+	"fmt"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"time"
+)
+
+// ConvertTask is published by the backend for every upload and processed by the converter.
+type ConvertTask struct {
+	JobId             string              `json:"job_id"`
+	FilenameProcessed string              `json:"filename_processed"`
+	FilenameRaw       string              `json:"filename_raw"`
+	Message           string              `json:"message"`
+	QueuedAt          time.Time           `json:"queued_at"`
+	K                 int                 `json:"k"`
+	Resize            *imaging.ResizeSpec `json:"resize,omitempty"`
+	Filter            string              `json:"filter,omitempty"`
+	Output            *imaging.OutputSpec `json:"output,omitempty"`
+	Preset            string              `json:"preset,omitempty"`
+	Variants          []Variant           `json:"variants,omitempty"`
+}
+
+// Variant is a single rendition of the raw image produced by a task.
+type Variant struct {
+	Name              string              `json:"name"`
+	FilenameProcessed string              `json:"filename_processed"`
+	Preset            string              `json:"preset,omitempty"`
+	Resize            *imaging.ResizeSpec `json:"resize,omitempty"`
+	Filter            string              `json:"filter,omitempty"`
+	Output            *imaging.OutputSpec `json:"output,omitempty"`
+}
+
+func (v *Variant) Validate() error {
+	if v.FilenameProcessed == "" {
+		return errs.Errorf(errs.Validation, "variant %q has no filename", v.Name)
+	}
+	if v.Resize != nil {
+		if err := v.Resize.Validate(); err != nil {
+			return fmt.Errorf("variant %q: %w", v.Name, err)
+		}
+	}
+	if v.Output != nil && v.Output.Format != "" {
+		if err := v.Output.Validate(); err != nil {
+			return fmt.Errorf("variant %q: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// AllVariants returns renditions requested by the task.
+// Tasks without variants describe a single rendition by their own fields.
+func (t *ConvertTask) AllVariants() []Variant {
+	if len(t.Variants) > 0 {
+		return t.Variants
+	}
+	return []Variant{{
+		FilenameProcessed: t.FilenameProcessed,
+		Preset:            t.Preset,
+		Resize:            t.Resize,
+		Filter:            t.Filter,
+		Output:            t.Output,
+	}}
+}
+
+type JobStatus string
+
+const (
+	JobStatusQueued     JobStatus = "queued"
+	JobStatusProcessing JobStatus = "processing"
+	JobStatusDone       JobStatus = "done"
+	JobStatusFailed     JobStatus = "failed"
+)
+
+// JobStatusEvent is emitted by the converter every time a task changes its state.
+type JobStatusEvent struct {
+	JobId     string    `json:"job_id"`
+	Status    JobStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ConvertResult is published by the converter to the results topic once a task is finished.
+type ConvertResult struct {
+	JobId             string          `json:"job_id"`
+	FilenameRaw       string          `json:"filename_raw"`
+	FilenameProcessed string          `json:"filename_processed,omitempty"`
+	ContentType       string          `json:"content_type,omitempty"`
+	Size              int64           `json:"size"`
+	Width             int             `json:"width"`
+	Height            int             `json:"height"`
+	Variants          []VariantResult `json:"variants,omitempty"`
+	DurationMs        int64           `json:"duration_ms"`
+	Attempts          int             `json:"attempts"`
+	Error             string          `json:"error,omitempty"`
+	FinishedAt        time.Time       `json:"finished_at"`
+}
+
+// VariantResult describes a stored rendition.
+type VariantResult struct {
+	Name              string `json:"name"`
+	FilenameProcessed string `json:"filename_processed"`
+	ContentType       string `json:"content_type"`
+	Size              int64  `json:"size"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+}
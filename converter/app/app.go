@@ -0,0 +1,29 @@
+// Package app starts the converter workers, so the all-in-one binary can run them next to the backend.
+package app
+
+import (
+	"context"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/converter/internal"
+	"github.com/ojgenbar/Colossus/converter/utils"
+	"log"
+	"sync"
+)
+
+func RegisterMetrics() {
+	internal.RegisterMetrics()
+}
+
+// Run processes tasks until ctx is canceled and in-flight tasks are finished.
+func Run(ctx context.Context, cfg *utils.Config) {
+	if cfg.Queue.Driver != queue.DriverMemory {
+		if err := internal.PrepareDeadLetterTopic(cfg.Kafka); err != nil {
+			log.Fatalf("Failed to prepare dead-letter topic: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	internal.StartProcessing(ctx, &wg, cfg)
+	wg.Wait()
+}
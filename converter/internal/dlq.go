@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/converter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers attached to messages sent to the dead-letter topic.
+const (
+	HeaderError             = "x-colossus-error"
+	HeaderErrorKind         = "x-colossus-error-kind"
+	HeaderAttempts          = "x-colossus-attempts"
+	HeaderOriginalTopic     = "x-colossus-original-topic"
+	HeaderOriginalPartition = "x-colossus-original-partition"
+	HeaderOriginalOffset    = "x-colossus-original-offset"
+	HeaderFailedAt          = "x-colossus-failed-at"
+	HeaderReplayed          = "x-colossus-replayed"
+
+	deadLetterHeaderPrefix = "x-colossus-"
+)
+
+// deadLetterTimeout bounds waiting for the dead-letter topic to accept a message.
+const deadLetterTimeout = 30 * time.Second
+
+var deadLetteredMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_converter_dead_lettered_messages",
+		Help: "Count messages sent to the dead-letter topic by reason: deserialize or the kind of the failure",
+	},
+	[]string{"reason"},
+)
+
+// DeadLetter sends the original message to the dead-letter topic,
+// keeping its payload and describing the failure in headers.
+// It waits for the delivery, so the original message may be marked done afterward,
+// but not longer than deadLetterTimeout: the message is then left to be handled again.
+func (p *EventProducer) DeadLetter(msg *queue.Message, reason string, cause error, attempts int) error {
+	if p.deadLetterTopic == "" {
+		log.Printf("Dead-letter topic is not configured, dropping message %s[%d]@%d\n", msg.Topic, msg.Partition, msg.Offset)
+		return nil
+	}
+
+	headers := append([]queue.Header{}, msg.Headers...)
+	headers = append(headers,
+		queue.Header{Key: HeaderError, Value: []byte(cause.Error())},
+		queue.Header{Key: HeaderErrorKind, Value: []byte(errs.KindOf(cause))},
+		queue.Header{Key: HeaderAttempts, Value: []byte(strconv.Itoa(attempts))},
+		queue.Header{Key: HeaderOriginalTopic, Value: []byte(msg.Topic)},
+		queue.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		queue.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		queue.Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+	err := p.publisher.Publish(ctx, &queue.Message{
+		Topic:   p.deadLetterTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return err
+	}
+	deadLetteredMessages.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// ReplayDeadLetters moves messages from the dead-letter topic back to the main topic.
+// It stops after `limit` messages (0 means no limit) or when no message arrives within `idle`.
+func ReplayDeadLetters(cfg *utils.Config, limit int, idle time.Duration) (int, error) {
+	q, err := NewQueue(cfg)
+	if err != nil {
+		return 0, err
+	}
+	consumer, err := q.Consumer(cfg.Kafka.GroupId+"_dlq_replay", []string{cfg.Kafka.DeadLetterTopic})
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+
+	publisher, err := q.Publisher()
+	if err != nil {
+		return 0, err
+	}
+	defer publisher.Close()
+
+	replayed := 0
+	lastMessageAt := time.Now()
+	for limit == 0 || replayed < limit {
+		if time.Since(lastMessageAt) > idle {
+			break
+		}
+
+		msg, err := consumer.Poll(100 * time.Millisecond)
+		if err != nil {
+			return replayed, err
+		}
+		if msg == nil {
+			continue
+		}
+		lastMessageAt = time.Now()
+
+		replay := &queue.Message{
+			Topic:   cfg.Kafka.Topic,
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: replayHeaders(msg.Headers),
+		}
+		err = publisher.Publish(context.Background(), replay)
+		if err != nil {
+			return replayed, err
+		}
+
+		consumer.Done(msg)
+		replayed++
+		log.Printf("Replayed %s[%d]@%d to %s[%d]@%d\n", msg.Topic, msg.Partition, msg.Offset, replay.Topic, replay.Partition, replay.Offset)
+	}
+	return replayed, nil
+}
+
+// replayHeaders drops the failure description and counts how many times the message was replayed.
+func replayHeaders(headers []queue.Header) []queue.Header {
+	replays := 0
+	var result []queue.Header
+	for _, h := range headers {
+		if h.Key == HeaderReplayed {
+			replays, _ = strconv.Atoi(string(h.Value))
+			continue
+		}
+		if strings.HasPrefix(h.Key, deadLetterHeaderPrefix) {
+			continue
+		}
+		result = append(result, h)
+	}
+	return append(result, queue.Header{Key: HeaderReplayed, Value: []byte(strconv.Itoa(replays + 1))})
+}
+
+// PrepareDeadLetterTopic creates the dead-letter topic if it does not exist yet.
+func PrepareDeadLetterTopic(cfg utils.Kafka) error {
+	if cfg.DeadLetterTopic == "" {
+		return nil
+	}
+
+	a, err := kafka.NewAdminClient(&kafka.ConfigMap{
+		"bootstrap.servers": cfg.BootstrapServers,
+	})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	results, err := a.CreateTopics(
+		ctx,
+		[]kafka.TopicSpecification{{
+			Topic:             cfg.DeadLetterTopic,
+			NumPartitions:     1,
+			ReplicationFactor: 1}},
+		kafka.SetAdminOperationTimeout(60*time.Second))
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		log.Printf("%s\n", result)
+	}
+	return nil
+}
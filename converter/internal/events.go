@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"github.com/ojgenbar/Colossus/converter/utils"
+	"log"
+	"time"
+)
+
+// EventProducer publishes converter events and dead letters. Failures to publish
+// events are only logged.
+type EventProducer struct {
+	publisher       queue.Publisher
+	statusTopic     string
+	resultsTopic    string
+	deadLetterTopic string
+}
+
+func NewEventProducer(publisher queue.Publisher, cfg utils.Kafka) *EventProducer {
+	return &EventProducer{
+		publisher:       publisher,
+		statusTopic:     cfg.StatusTopic,
+		resultsTopic:    cfg.ResultsTopic,
+		deadLetterTopic: cfg.DeadLetterTopic,
+	}
+}
+
+func (p *EventProducer) EmitStatus(task *tasks.ConvertTask, status tasks.JobStatus, err error) {
+	if task.JobId == "" {
+		return
+	}
+
+	event := tasks.JobStatusEvent{
+		JobId:     task.JobId,
+		Status:    status,
+		Timestamp: time.Now().UTC(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.produce(p.statusTopic, task.JobId, &event)
+}
+
+func (p *EventProducer) EmitResult(result *tasks.ConvertResult) {
+	if p.resultsTopic == "" {
+		return
+	}
+	p.produce(p.resultsTopic, result.FilenameRaw, result)
+}
+
+func (p *EventProducer) produce(topic string, key string, value interface{}) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Failed to marshal event: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = p.publisher.Publish(ctx, &queue.Message{
+		Topic: topic,
+		Key:   []byte(key),
+		Value: b,
+	})
+	if err != nil {
+		log.Printf("Failed to produce event to %s: %s\n", topic, err)
+	}
+}
+
+// Close waits for outstanding events to be delivered and closes the publisher.
+func (p *EventProducer) Close() {
+	p.publisher.Close()
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "colossus_converter_queue_depth",
+		Help: "Number of messages waiting for a free worker",
+	},
+)
+
+var inFlightMessages = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "colossus_converter_in_flight_messages",
+		Help: "Number of messages polled but not finished yet",
+	},
+)
+
+var busyWorkers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "colossus_converter_busy_workers",
+		Help: "Number of workers currently processing a message",
+	},
+)
+
+// work is a message handed to a worker.
+type work struct {
+	msg *queue.Message
+	err error
+}
@@ -1,25 +1,26 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/common/storage"
+	"github.com/ojgenbar/Colossus/common/tasks"
 	"github.com/ojgenbar/Colossus/converter/utils"
 	"github.com/prometheus/client_golang/prometheus"
-	"golang.org/x/image/bmp"
-	"golang.org/x/image/draw"
-	"golang.org/x/image/tiff"
+	"golang.org/x/sync/semaphore"
 	"image"
 	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"log"
-	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,229 +49,667 @@ var processedImagesSuccessBytes = prometheus.NewCounterVec(
 	[]string{"mime_type"},
 )
 
+var guardedFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "colossus_converter_guarded_failures",
+		Help: "Count tasks failed permanently by resource guards: max_pixels, max_animation_pixels, memory_budget, timeout or panic",
+	},
+	[]string{"reason"},
+)
+
+var processingRetries = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "colossus_converter_processing_retries",
+		Help: "Count retried attempts to process raw images",
+	},
+)
+
 func RegisterMetrics() {
 	prometheus.MustRegister(processedImagesSuccess)
 	prometheus.MustRegister(processedImagesFailure)
 	prometheus.MustRegister(processedImagesSuccessBytes)
+	prometheus.MustRegister(processingRetries)
+	prometheus.MustRegister(guardedFailures)
+	prometheus.MustRegister(deadLetteredMessages)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(inFlightMessages)
+	prometheus.MustRegister(busyWorkers)
+}
+
+func RetrieveStoredFile(store storage.ObjectStore, bucketName string, objectName string) (io.ReadCloser, string, error) {
+	object, objectInfo, err := store.Get(context.Background(), bucketName, objectName)
+	if err != nil {
+		log.Println(err)
+		return nil, "", err
+	}
+	return object, objectInfo.ContentType, nil
+}
+
+// Processor converts tasks. It is safe for concurrent use by several workers.
+type Processor struct {
+	store  storage.ObjectStore
+	s3cfg  *config.S3
+	events *EventProducer
+	policy RetryPolicy
+	// defaultFilter is used for tasks which do not select a filter
+	defaultFilter string
+	presets       map[string]config.Preset
+	// memory limits bytes of raw and decoded images held by all workers together
+	memory      *semaphore.Weighted
+	memoryLimit int64
+	// taskMemory, maxPixels, maxAnimationPixels and taskTimeout reject images a single task can not afford
+	taskMemory         int64
+	maxPixels          int64
+	maxAnimationPixels int64
+	taskTimeout        time.Duration
+	// keepSafeMetadata copies the safe EXIF tags of the raw image to variants
+	keepSafeMetadata bool
+}
+
+func NewProcessor(store storage.ObjectStore, cfg *utils.Config, events *EventProducer) *Processor {
+	memoryLimit := cfg.Workers.MaxMemoryBytes
+	if memoryLimit <= 0 {
+		memoryLimit = 384 << 20
+	}
+	taskMemory := cfg.Workers.TaskMemoryBytes
+	if taskMemory <= 0 {
+		taskMemory = memoryLimit
+	}
+	maxPixels := cfg.Convert.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = 100_000_000
+	}
+	maxAnimationPixels := cfg.Convert.MaxAnimationPixels
+	if maxAnimationPixels <= 0 {
+		maxAnimationPixels = 500_000_000
+	}
+	taskTimeout := time.Duration(cfg.Workers.TaskTimeoutMs) * time.Millisecond
+	if taskTimeout <= 0 {
+		taskTimeout = 2 * time.Minute
+	}
+	return &Processor{
+		store:              store,
+		s3cfg:              &cfg.S3,
+		events:             events,
+		policy:             NewRetryPolicy(cfg.Retry),
+		defaultFilter:      cfg.Convert.DefaultFilter,
+		presets:            cfg.Presets,
+		memory:             semaphore.NewWeighted(memoryLimit),
+		memoryLimit:        memoryLimit,
+		taskMemory:         taskMemory,
+		maxPixels:          maxPixels,
+		maxAnimationPixels: maxAnimationPixels,
+		taskTimeout:        taskTimeout,
+
+		keepSafeMetadata: cfg.Convert.KeepSafeMetadata,
+	}
 }
 
-func createConsumer(cfg utils.Kafka) (*kafka.Consumer, error) {
-	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":        cfg.BootstrapServers,
-		"group.id":                 cfg.GroupId,
-		"session.timeout.ms":       cfg.SessionTimeoutMs,
-		"auto.offset.reset":        cfg.AutoOffsetReset,
-		"enable.auto.commit":       true,
-		"allow.auto.create.topics": false,
-	})
+// ProcessOne converts a single task, retrying it according to the policy unless the failure
+// is permanent, and reports its progress via status and result events.
+// It returns the number of attempts made.
+func (p *Processor) ProcessOne(task *tasks.ConvertTask) (int, error) {
+	p.events.EmitStatus(task, tasks.JobStatusProcessing, nil)
 
+	startedAt := time.Now()
+	result := tasks.ConvertResult{
+		JobId:       task.JobId,
+		FilenameRaw: task.FilenameRaw,
+	}
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		err = p.guardedProcessOne(task, &result)
+		if err == nil || attempt >= p.policy.MaxAttempts {
+			break
+		}
+		if errs.Permanent(err) {
+			log.Printf("Attempt %d failed permanently (%s): %s\n", attempt, errs.KindOf(err), err)
+			break
+		}
+		backoff := p.policy.Backoff(attempt + 1)
+		log.Printf("Attempt %d of %d failed: %s, retrying in %s\n", attempt, p.policy.MaxAttempts, err, backoff)
+		processingRetries.Inc()
+		time.Sleep(backoff)
+	}
+
+	result.Attempts = attempt
+	result.DurationMs = time.Since(startedAt).Milliseconds()
+	result.FinishedAt = time.Now().UTC()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	p.events.EmitResult(&result)
+
+	if err != nil {
+		p.events.EmitStatus(task, tasks.JobStatusFailed, err)
+		return attempt, err
+	}
+	p.events.EmitStatus(task, tasks.JobStatusDone, nil)
+	return attempt, nil
+}
+
+type attemptResult struct {
+	variants []tasks.VariantResult
+	err      error
+}
+
+// guardedProcessOne makes a single attempt and stores every variant requested by the task,
+// reusing variants stored by an earlier attempt.
+func (p *Processor) guardedProcessOne(task *tasks.ConvertTask, result *tasks.ConvertResult) error {
+	variants := task.AllVariants()
+	for i := range variants {
+		if err := applyPreset(&variants[i], p.presets); err != nil {
+			return err
+		}
+		if err := variants[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	results := make([]tasks.VariantResult, len(variants))
+	var pending []int
+	for i, variant := range variants {
+		// The task may be redelivered after a crash, do not convert it twice
+		existing, err := p.store.Stat(context.Background(), p.s3cfg.Buckets.Processed.Name, variant.FilenameProcessed)
+		if err != nil {
+			pending = append(pending, i)
+			continue
+		}
+		log.Printf("Processed image %s already exists, skipping\n", variant.FilenameProcessed)
+		width, height := dimensionsFromMetadata(existing.Metadata)
+		results[i] = tasks.VariantResult{
+			Name:              variant.Name,
+			FilenameProcessed: existing.Key,
+			ContentType:       existing.ContentType,
+			Size:              existing.Size,
+			Width:             width,
+			Height:            height,
+		}
+	}
+
+	if len(pending) > 0 {
+		todo := make([]tasks.Variant, len(pending))
+		for i, index := range pending {
+			todo[i] = variants[index]
+		}
+		converted, err := p.guardedConvert(task, todo)
+		if err != nil {
+			return err
+		}
+		for i, index := range pending {
+			results[index] = converted[i]
+		}
+	}
+
+	result.Variants = results
+	first := results[0]
+	result.FilenameProcessed = first.FilenameProcessed
+	result.ContentType = first.ContentType
+	result.Size = first.Size
+	result.Width = first.Width
+	result.Height = first.Height
+	return nil
+}
+
+// guardedConvert decodes the raw image once and stores the variants. The raw image is fetched and its
+// memory reserved before the task timeout starts, so waiting behind other tasks is not mistaken for
+// a slow image. Decoding and converting run within the timeout, a panic there becomes an error.
+// An attempt which timed out is abandoned, it keeps its memory reservation until it actually returns.
+func (p *Processor) guardedConvert(task *tasks.ConvertTask, variants []tasks.Variant) ([]tasks.VariantResult, error) {
+	file, err := p.fetchRaw(context.Background(), task.FilenameRaw, keepsAnimation(variants))
+	if err != nil {
+		return nil, err
+	}
+	release, err := p.reserveMemory(context.Background(), file, task, variants)
 	if err != nil {
-		log.Fatalf("Failed to create consumer: %s\n", err)
 		return nil, err
 	}
 
-	log.Printf("Created Consumer %v\n", c)
-	return c, nil
+	ctx, cancel := context.WithTimeout(context.Background(), p.taskTimeout)
+	defer cancel()
+
+	done := make(chan attemptResult, 1)
+	go func() {
+		defer release()
+		var attempt attemptResult
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic while processing %s: %v\n%s", task.FilenameRaw, r, debug.Stack())
+				guardedFailures.WithLabelValues("panic").Inc()
+				attempt.err = errs.Errorf(errs.Unprocessable, "processing panicked: %v", r)
+			}
+			done <- attempt
+		}()
+		attempt.variants, attempt.err = p.convertVariants(ctx, file, task, variants)
+	}()
+
+	var attempt attemptResult
+	select {
+	case attempt = <-done:
+	case <-ctx.Done():
+		attempt.err = ctx.Err()
+	}
+	if attempt.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		guardedFailures.WithLabelValues("timeout").Inc()
+		return nil, errs.Errorf(errs.Unprocessable, "processing timed out after %s", p.taskTimeout)
+	}
+	if attempt.err != nil {
+		return nil, attempt.err
+	}
+	return attempt.variants, nil
 }
 
-func initializeS3Client(s3cfg utils.S3) (*minio.Client, error) {
-	endpoint := s3cfg.Auth.Endpoint
-	accessKeyID := s3cfg.Auth.AccessKeyID
-	secretAccessKey := s3cfg.Auth.SecretAccessKey
-	// Initialize minio client object.
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds: credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		//Secure: useSSL,
-	})
+// convertVariants decodes the raw image and stores every variant.
+func (p *Processor) convertVariants(ctx context.Context, file *rawFile, task *tasks.ConvertTask, variants []tasks.Variant) ([]tasks.VariantResult, error) {
+	raw, err := decodeRaw(file)
 	if err != nil {
-		log.Fatalln(err)
 		return nil, err
 	}
-	return minioClient, nil
+	var results []tasks.VariantResult
+	for _, variant := range variants {
+		variantResult, err := p.storeVariant(ctx, raw, task, &variant)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *variantResult)
+	}
+	return results, nil
+}
+
+// rawFile is the raw image as stored, before decoding.
+type rawFile struct {
+	data   []byte
+	format *imaging.ImageFormat
+	exif   *imaging.Exif
+	// frames to decode, more than one only for an animation some variant keeps
+	frames int64
 }
 
-func getDecodeEncodeFunctionsByMimeType(mimeType string) (
-	func(r io.Reader) (image.Image, error),
-	func(w io.Writer, m image.Image) error,
-	error,
-) {
-	switch mimeType {
-	case "image/jpeg", "image/jpg":
-		encodeFunc := func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) }
-		return jpeg.Decode, encodeFunc, nil
-	case "image/png":
-		return png.Decode, png.Encode, nil
-	case "image/gif":
-		encodeFunc := func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) }
-		return gif.Decode, encodeFunc, nil
-	case "image/bmp", "image/x-ms-bmp":
-		return bmp.Decode, bmp.Encode, nil
-	case "image/tiff", "image/tif":
-		encodeFunc := func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) }
-		return tiff.Decode, encodeFunc, nil
-	// Add more cases for other image types if needed
-	default:
-		return nil, nil, errors.New("unsupported MIME type")
+// rawImage is the decoded raw image, turned upright according to its EXIF orientation.
+type rawImage struct {
+	src    image.Image
+	format *imaging.ImageFormat
+	exif   *imaging.Exif
+	// animation holds all frames of an animated GIF, src is its first frame then
+	animation *gif.GIF
+}
+
+// keepsAnimation reports whether any variant would keep an animated raw image animated.
+func keepsAnimation(variants []tasks.Variant) bool {
+	for _, variant := range variants {
+		if variant.Output.KeepsAnimation() {
+			return true
+		}
 	}
+	return false
 }
 
-func convert(input io.Reader, output *io.PipeWriter, contentType string, k int) error {
-	decodeFunc, encodeFunc, err := getDecodeEncodeFunctionsByMimeType(contentType)
+// fetchRaw reads the raw image and what tells the memory it needs decoded. Frames of an animated GIF
+// are counted only if some variant keeps the animation.
+func (p *Processor) fetchRaw(ctx context.Context, filenameRaw string, animate bool) (*rawFile, error) {
+	//get image stream
+	object, contentType, err := RetrieveStoredFile(p.store, p.s3cfg.Buckets.Raw.Name, filenameRaw)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Decode the image:
-	src, _ := decodeFunc(input)
+	inFormat, err := imaging.FormatByMimeType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	exif, err := imaging.ReadExif(data, inFormat)
+	if err != nil {
+		// The image is still usable, as it is
+		log.Printf("Failed to read EXIF of %s: %s\n", filenameRaw, err)
+	}
 
-	// Set the expected size that you want:
-	dst := image.NewRGBA(image.Rect(0, 0, src.Bounds().Max.X/k, src.Bounds().Max.Y/k))
+	file := &rawFile{data: data, format: inFormat, exif: exif, frames: 1}
+	if animate && inFormat.Name == "gif" {
+		count, err := imaging.CountGIFFrames(data)
+		if err != nil {
+			return nil, err
+		}
+		file.frames = int64(count)
+	}
+	return file, nil
+}
 
-	// Resize:
-	draw.NearestNeighbor.Scale(dst, dst.Rect, src, src.Bounds(), draw.Over, nil)
+// decodeRaw decodes the raw image, all frames of an animation.
+func decodeRaw(file *rawFile) (*rawImage, error) {
+	if file.frames > 1 {
+		animation, err := gif.DecodeAll(bytes.NewReader(file.data))
+		if err != nil {
+			return nil, errs.Wrap(errs.UnsupportedMedia, err)
+		}
+		return &rawImage{src: animation.Image[0], format: file.format, exif: file.exif, animation: animation}, nil
+	}
 
-	// Encode to `output`:
-	err = encodeFunc(output, dst)
+	// Decode the image:
+	src, err := file.format.Decode(bytes.NewReader(file.data))
 	if err != nil {
-		return err
+		return nil, errs.Wrap(errs.UnsupportedMedia, err)
 	}
-	defer output.Close()
-	return nil
+	return &rawImage{src: imaging.Orient(src, file.exif.Orientation()), format: file.format, exif: file.exif}, nil
+}
+
+// taskK returns the factor legacy tasks divide both dimensions by.
+func taskK(task *tasks.ConvertTask) int {
+	if task.K > 1 {
+		return task.K
+	}
+	return 2
 }
 
-func RetrieveS3File(clientS3 *minio.Client, bucketName string, objectName string) (*minio.Object, string, error) {
-	var minioClient = clientS3
+// storeVariant renders a single variant and puts it to the processed bucket.
+// Metadata of the raw image is stripped, unless the safe tags are configured to be kept.
+func (p *Processor) storeVariant(ctx context.Context, raw *rawImage, task *tasks.ConvertTask, variant *tasks.Variant) (*tasks.VariantResult, error) {
+	filter, err := imaging.GetFilter(variant.Filter, p.defaultFilter)
+	if err != nil {
+		return nil, err
+	}
+	outFormat, err := imaging.OutputFormat(raw.format, variant.Output)
+	if err != nil {
+		return nil, err
+	}
 
-	objectInfo, err := minioClient.StatObject(context.Background(), bucketName, objectName, minio.GetObjectOptions{})
+	options := imaging.Options{
+		Resize: variant.Resize,
+		K:      taskK(task),
+		Filter: filter,
+		Output: variant.Output,
+	}
+	var output bytes.Buffer
+	var rect image.Rectangle
+	if raw.animation != nil && variant.Output.KeepsAnimation() {
+		rect, err = imaging.ConvertAnimation(raw.animation, &output, options)
+	} else {
+		rect, err = imaging.Convert(raw.src, &output, outFormat, options)
+	}
 	if err != nil {
 		log.Println(err)
-		return nil, "", err
+		return nil, err
+	}
+	data := output.Bytes()
+	if p.keepSafeMetadata {
+		if safe := raw.exif.Safe(); safe != nil {
+			data = imaging.WithExif(data, outFormat, safe)
+		}
 	}
 
-	object, err := minioClient.GetObject(context.Background(), bucketName, objectName, minio.GetObjectOptions{})
+	// An attempt abandoned by the timeout must not store a variant of a task retried or failed since
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	info, err := p.store.Put(
+		ctx, p.s3cfg.Buckets.Processed.Name, variant.FilenameProcessed, bytes.NewReader(data),
+		int64(len(data)), storage.PutOptions{
+			ContentType: outFormat.MimeType,
+			Metadata: map[string]string{
+				storage.MetadataWidth:  strconv.Itoa(rect.Dx()),
+				storage.MetadataHeight: strconv.Itoa(rect.Dy()),
+			},
+		},
+	)
 	if err != nil {
 		log.Println(err)
-		return nil, "", err
+		return nil, err
 	}
-	//retrievedRawImages.WithLabelValues(bucketName).Inc()
-	return object, objectInfo.ContentType, nil
+	log.Printf("Successfully uploaded processed image, info: %+v", info)
+	processedImagesSuccessBytes.WithLabelValues(raw.format.MimeType).Add(float64(info.Size))
+	//safe image at processed bucket
+	return &tasks.VariantResult{
+		Name:              variant.Name,
+		FilenameProcessed: info.Key,
+		ContentType:       outFormat.MimeType,
+		Size:              info.Size,
+		Width:             rect.Dx(),
+		Height:            rect.Dy(),
+	}, nil
 }
 
-func ProcessOne(clientS3 *minio.Client, cfg *utils.S3, task *ConvertTask) error {
-	var k = 2
-	if task.K > 1 {
-		k = task.K
+// reserveMemory blocks until the raw image, its decoded pixels and the canvases of the variants fit
+// into the memory limit. Images with more pixels than allowed or exceeding the task budget are rejected
+// before decoding. An image larger than the whole limit waits until it is the only one being processed.
+// Frames of an animation are paletted, a byte per pixel, and resized one by one.
+func (p *Processor) reserveMemory(ctx context.Context, file *rawFile, task *tasks.ConvertTask, variants []tasks.Variant) (func(), error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(file.data))
+	if err != nil {
+		return nil, errs.Wrap(errs.UnsupportedMedia, err)
 	}
 
-	ctx := context.Background()
-
-	//get image stream
-	object, contentType, err := RetrieveS3File(clientS3, cfg.Buckets.Raw.Name, task.FilenameRaw)
+	// Turning the image upright needs two more copies of its pixels
+	decodedCopies := int64(1)
+	if file.frames == 1 && file.exif.Orientation() != 1 {
+		decodedCopies = 3
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > p.maxPixels {
+		guardedFailures.WithLabelValues("max_pixels").Inc()
+		return nil, errs.Errorf(errs.TooLarge, "image is %dx%d, at most %d pixels are allowed", config.Width, config.Height, p.maxPixels)
+	}
+	frames := file.frames
+	if frames > 1 && frames*pixels > p.maxAnimationPixels {
+		guardedFailures.WithLabelValues("max_animation_pixels").Inc()
+		return nil, errs.Errorf(errs.TooLarge, "animation has %d frames of %dx%d, at most %d pixels in total are allowed", frames, config.Width, config.Height, p.maxAnimationPixels)
+	}
+	weight := int64(len(file.data)) + pixels*4*decodedCopies
+	if frames > 1 {
+		weight += frames * pixels
+	}
+	// Upscaling makes canvases of any size up to the largest dimension allowed, however small the image is
+	upright := image.Rect(0, 0, config.Width, config.Height)
+	if frames == 1 && file.exif.Orientation() >= 5 {
+		upright = image.Rect(0, 0, config.Height, config.Width)
+	}
+	for _, variant := range variants {
+		bounds, err := imaging.Options{Resize: variant.Resize, K: taskK(task)}.OutputBounds(upright)
+		if err != nil {
+			return nil, errs.Wrap(errs.Unprocessable, err)
+		}
+		canvas := int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+		if frames > 1 && variant.Output.KeepsAnimation() {
+			canvas *= frames
+		}
+		weight += canvas
+	}
+	if weight > p.taskMemory {
+		guardedFailures.WithLabelValues("memory_budget").Inc()
+		return nil, errs.Errorf(errs.TooLarge, "image needs %d bytes of memory, the task budget is %d", weight, p.taskMemory)
+	}
+	if weight > p.memoryLimit {
+		weight = p.memoryLimit
+	}
+	err = p.memory.Acquire(ctx, weight)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer object.Close()
-
-	pr, pw := io.Pipe()
-	defer pr.Close()
+	return func() { p.memory.Release(weight) }, nil
+}
 
-	errs := make(chan error, 1)
-	go func() {
-		err = convert(object, pw, contentType, k)
-		errs <- err
-		close(errs)
-	}()
+func dimensionsFromMetadata(metadata map[string]string) (width int, height int) {
+	for key, value := range metadata {
+		switch {
+		case strings.EqualFold(key, storage.MetadataWidth):
+			width, _ = strconv.Atoi(value)
+		case strings.EqualFold(key, storage.MetadataHeight):
+			height, _ = strconv.Atoi(value)
+		}
+	}
+	return width, height
+}
 
-	info, err := clientS3.PutObject(
-		ctx, cfg.Buckets.Processed.Name, task.FilenameProcessed, pr,
-		-1, minio.PutObjectOptions{ContentType: contentType},
-	)
+// HandleMessage processes a single message. A nil result means the message is finished
+// (converted or moved to the dead-letter topic) and its offset may be committed.
+// Dead letters are counted by the kind of the failure.
+func (p *Processor) HandleMessage(msg *queue.Message) error {
+	partition := strconv.Itoa(int(msg.Partition))
 
-	err = <-errs
+	value := tasks.ConvertTask{}
+	err := json.Unmarshal(msg.Value, &value)
 	if err != nil {
-		log.Fatalln(err)
-		return err
+		log.Printf("Failed to deserialize payload: %s\n", err)
+		return p.events.DeadLetter(msg, "deserialize", errs.Wrap(errs.Validation, err), 1)
+	}
+
+	log.Printf("%% Message on %s[%d]@%d:\n%+v\n", msg.Topic, msg.Partition, msg.Offset, value)
+	if msg.Headers != nil {
+		log.Printf("%% Headers: %v\n", msg.Headers)
 	}
 
+	attempts, err := p.ProcessOne(&value)
 	if err != nil {
-		log.Fatalln(err)
-		return err
+		log.Printf("Failed to process: %s\n", err)
+		processedImagesFailure.WithLabelValues(partition).Inc()
+		return p.events.DeadLetter(msg, string(errs.KindOf(err)), err, attempts)
 	}
-	log.Printf("Successfully uploaded processed image, info: %s", info)
-	processedImagesSuccessBytes.WithLabelValues(contentType).Add(float64(info.Size))
-	//safe image at processed bucket
+	processedImagesSuccess.WithLabelValues(partition).Inc()
 	return nil
 }
 
-func StartProcessing(sigchan chan os.Signal, wg *sync.WaitGroup, cfg *utils.Config) {
-	var topics = []string{cfg.Kafka.Topic}
-	consumer, err := createConsumer(cfg.Kafka)
+var errStopped = errors.New("converter is stopping")
+
+// startWorkers runs workers until the queue is closed. A message which could be neither
+// processed nor dead-lettered is retried until it succeeds or the converter stops.
+func startWorkers(count int, processor *Processor, queue <-chan work, results chan<- work, stop <-chan struct{}, wg *sync.WaitGroup) {
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range queue {
+				queueDepth.Dec()
+				select {
+				case <-stop:
+					// Not started yet, it will be redelivered after restart
+					w.err = errStopped
+					results <- w
+					continue
+				default:
+				}
+				busyWorkers.Inc()
+				for {
+					w.err = processor.HandleMessage(w.msg)
+					if w.err == nil {
+						break
+					}
+					log.Printf("Failed to finish message %s[%d]@%d, retrying: %s\n", w.msg.Topic, w.msg.Partition, w.msg.Offset, w.err)
+					select {
+					case <-stop:
+					case <-time.After(processor.policy.MaxBackoff):
+						continue
+					}
+					break
+				}
+				busyWorkers.Dec()
+				results <- w
+			}
+		}()
+	}
+}
+
+// StartProcessing consumes tasks until ctx is canceled, then waits for in-flight tasks and calls wg.Done.
+func StartProcessing(ctx context.Context, wg *sync.WaitGroup, cfg *utils.Config) {
+	q, err := NewQueue(cfg)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Failed to create queue: %s\n", err)
+	}
+	consumer, err := q.Consumer("", []string{cfg.Kafka.Topic})
+	if err != nil {
+		log.Fatalf("Failed to create consumer: %s\n", err)
 	}
 
-	err = consumer.SubscribeTopics(topics, nil)
+	publisher, err := q.Publisher()
 	if err != nil {
 		panic(err)
 	}
+	events := NewEventProducer(publisher, cfg.Kafka)
 
-	clientS3, err := initializeS3Client(cfg.S3)
+	store, err := storage.New(&cfg.Storage, &cfg.S3)
 	if err != nil {
 		panic(err)
 	}
+	processor := NewProcessor(store, cfg, events)
+
+	workersCount := cfg.Workers.Count
+	if workersCount < 1 {
+		workersCount = 1
+	}
+	maxInFlight := cfg.Workers.MaxInFlight
+	if maxInFlight < workersCount {
+		maxInFlight = workersCount
+	}
+
+	queue := make(chan work, maxInFlight)
+	results := make(chan work, maxInFlight)
+	stop := make(chan struct{})
+	var workersWg sync.WaitGroup
+	startWorkers(workersCount, processor, queue, results, stop, &workersWg)
+	running := 0
+
+	finish := func(w work) {
+		running--
+		inFlightMessages.Set(float64(running))
+		if w.err == nil {
+			consumer.Done(w.msg)
+		}
+	}
 
 	run := true
 	for run {
 		select {
-		case sig := <-sigchan:
-			log.Printf("Caught signal %v: terminating\n", sig)
+		case <-ctx.Done():
+			log.Printf("Processing canceled: terminating\n")
 			run = false
+		case w := <-results:
+			finish(w)
 		default:
-			ev := consumer.Poll(100)
-			if ev == nil {
+			if running >= maxInFlight || consumer.InFlight() >= maxInFlight {
+				// All slots are taken, wait for a worker to finish
+				select {
+				case w := <-results:
+					finish(w)
+				case <-time.After(100 * time.Millisecond):
+				}
 				continue
 			}
 
-			switch e := ev.(type) {
-			case *kafka.Message:
-				value := ConvertTask{}
-				err = json.Unmarshal(e.Value, &value)
-				if err != nil {
-					log.Printf("Failed to deserialize payload: %s\n", err)
-				} else {
-					log.Printf("%% Message on %s:\n%+v\n", e.TopicPartition, value)
-					err = ProcessOne(clientS3, &cfg.S3, &value)
-					if err != nil {
-						log.Printf("Failed to process: %s\n", err)
-						processedImagesFailure.WithLabelValues(strconv.Itoa(int(e.TopicPartition.Partition))).Inc()
-					} else {
-						processedImagesSuccess.WithLabelValues(strconv.Itoa(int(e.TopicPartition.Partition))).Inc()
-					}
-				}
-				if e.Headers != nil {
-					log.Printf("%% Headers: %v\n", e.Headers)
-				}
-			case kafka.Error:
-				// Errors should generally be considered
-				// informational, the client will try to
-				// automatically recover.
-				log.Printf("Error: %v: %v\n", e.Code(), e)
-			default:
-				log.Printf("Ignored event %v\n", e)
+			msg, err := consumer.Poll(100 * time.Millisecond)
+			if err != nil {
+				log.Printf("Failed to poll: %s\n", err)
+				run = false
+				continue
 			}
+			if msg == nil {
+				continue
+			}
+			running++
+			inFlightMessages.Set(float64(running))
+			queueDepth.Inc()
+			queue <- work{msg: msg}
 		}
 	}
 
+	log.Printf("Waiting for %d in-flight messages\n", running)
+	close(stop)
+	close(queue)
+	go func() {
+		workersWg.Wait()
+		close(results)
+	}()
+	for w := range results {
+		finish(w)
+	}
+
 	log.Printf("Closing consumer\n")
 	consumer.Close()
+	events.Close()
 	log.Println("Graceful consumer shutdown complete.")
 	wg.Done()
 }
-
-type ConvertTask struct {
-	FilenameProcessed string    `json:"filename_processed"`
-	FilenameRaw       string    `json:"filename_raw"`
-	Message           string    `json:"message"`
-	QueuedAt          time.Time `json:"queued_at"`
-	K                 int       `json:"k"`
-}
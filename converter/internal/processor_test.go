@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/tasks"
+	"golang.org/x/sync/semaphore"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestReserveMemoryAnimationLimit(t *testing.T) {
+	// Six frames of 40x20, 4800 pixels in total
+	var g gif.GIF
+	for range 6 {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 40, 20), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &g); err != nil {
+		t.Fatal(err)
+	}
+	format, err := imaging.FormatByName("gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		frames             int64
+		maxAnimationPixels int64
+		want               errs.Kind
+	}{
+		{"within the limit", 6, 4800, ""},
+		{"over the limit", 6, 4799, errs.TooLarge},
+		{"poster only", 1, 4799, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Processor{
+				memory:             semaphore.NewWeighted(1 << 20),
+				memoryLimit:        1 << 20,
+				taskMemory:         1 << 20,
+				maxPixels:          1_000_000,
+				maxAnimationPixels: tt.maxAnimationPixels,
+			}
+			file := &rawFile{data: buf.Bytes(), format: format, frames: tt.frames}
+			variants := []tasks.Variant{{Name: "default", Resize: &imaging.ResizeSpec{Width: 20, Mode: imaging.ResizeModeFit}}}
+			release, err := p.reserveMemory(context.Background(), file, &tasks.ConvertTask{}, variants)
+			if tt.want != "" {
+				if !errs.Is(err, tt.want) || !errs.Permanent(err) {
+					t.Fatalf("got %v, want a permanent %s", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+			if !p.memory.TryAcquire(1 << 20) {
+				t.Error("memory is not released")
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package internal
+
+import (
+	"github.com/ojgenbar/Colossus/common/queue"
+	"github.com/ojgenbar/Colossus/converter/utils"
+)
+
+// NewQueue returns the client of the broker selected by the config.
+func NewQueue(cfg *utils.Config) (*queue.Client, error) {
+	return queue.New(&cfg.Queue, queue.KafkaConfig{
+		BootstrapServers: cfg.Kafka.BootstrapServers,
+		ClientId:         cfg.Kafka.ClientId,
+		Acks:             cfg.Kafka.Acks,
+		GroupId:          cfg.Kafka.GroupId,
+		SessionTimeoutMs: cfg.Kafka.SessionTimeoutMs,
+		AutoOffsetReset:  cfg.Kafka.AutoOffsetReset,
+		CommitIntervalMs: cfg.Kafka.CommitIntervalMs,
+	})
+}
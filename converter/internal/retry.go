@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"github.com/ojgenbar/Colossus/converter/utils"
+	"time"
+)
+
+// RetryPolicy describes how many times a task is attempted and how long to wait in between.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+func NewRetryPolicy(cfg utils.Retry) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: time.Duration(cfg.InitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(cfg.MaxBackoffMs) * time.Millisecond,
+		Multiplier:     cfg.Multiplier,
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	return policy
+}
+
+// Backoff returns the delay before the given attempt (attempts are counted from 1).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt-1; i++ {
+		delay *= p.Multiplier
+		if delay >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(delay)
+}
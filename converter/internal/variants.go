@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"github.com/ojgenbar/Colossus/common/config"
+	"github.com/ojgenbar/Colossus/common/errs"
+	"github.com/ojgenbar/Colossus/common/imaging"
+	"github.com/ojgenbar/Colossus/common/tasks"
+)
+
+// applyPreset fills options the variant does not set explicitly from the preset it refers to.
+func applyPreset(v *tasks.Variant, presets map[string]config.Preset) error {
+	if v.Preset == "" {
+		return nil
+	}
+	preset, ok := presets[v.Preset]
+	if !ok {
+		if v.Resize != nil || v.Output != nil {
+			// Already resolved by the producer
+			return nil
+		}
+		return errs.Errorf(errs.Validation, "unknown preset %q", v.Preset)
+	}
+
+	if v.Resize == nil && (preset.Width != 0 || preset.Height != 0) {
+		v.Resize = &imaging.ResizeSpec{
+			Width:      preset.Width,
+			Height:     preset.Height,
+			Mode:       imaging.ResizeMode(preset.Mode),
+			Background: preset.Background,
+			Upscale:    preset.Upscale,
+		}
+		if v.Resize.Mode == "" {
+			v.Resize.Mode = imaging.ResizeModeFit
+		}
+	}
+	if v.Filter == "" {
+		v.Filter = preset.Filter
+	}
+	if v.Output == nil && (preset.Format != "" || preset.Poster) {
+		v.Output = &imaging.OutputSpec{
+			Format:      preset.Format,
+			Quality:     preset.Quality,
+			Compression: preset.Compression,
+			Poster:      preset.Poster,
+		}
+	}
+	return nil
+}
@@ -3,15 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/ojgenbar/Colossus/common/metrics"
+	"github.com/ojgenbar/Colossus/converter/app"
 	"github.com/ojgenbar/Colossus/converter/internal"
 	"github.com/ojgenbar/Colossus/converter/utils"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -24,23 +25,41 @@ func Prepare() *utils.Config {
 	if err != nil {
 		log.Fatal(err)
 	}
-	internal.RegisterMetrics()
+	app.RegisterMetrics()
 	return cfg
 }
 
+// ReplayDeadLetters implements `converter replay-dlq`, which moves failed tasks back to the main topic.
+func ReplayDeadLetters(cfg *utils.Config, args []string) {
+	flags := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	limit := flags.Int("limit", 0, "maximum number of messages to replay, 0 means all")
+	idle := flags.Duration("idle", 10*time.Second, "stop after no messages were received for this long")
+	_ = flags.Parse(args)
+
+	replayed, err := internal.ReplayDeadLetters(cfg, *limit, *idle)
+	log.Printf("Replayed %d messages from %s to %s\n", replayed, cfg.Kafka.DeadLetterTopic, cfg.Kafka.Topic)
+	if err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+}
+
 func main() {
 	cfg := Prepare()
 
-	var wg sync.WaitGroup
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	go internal.StartProcessing(sigChan, &wg, cfg)
-	wg.Add(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay-dlq":
+			ReplayDeadLetters(cfg, os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
 
-	server := &http.Server{Addr: cfg.Servers.System.Addr}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	http.Handle("/metrics", promhttp.Handler())
+	server := metrics.NewServer(cfg.Servers.System.Addr)
 
 	go func() {
 		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
@@ -50,7 +69,7 @@ func main() {
 	}()
 
 	// Wait until Consumer stops gracefully, then stop metrics server
-	wg.Wait()
+	app.Run(ctx, cfg)
 
 	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownRelease()
@@ -1,67 +1,74 @@
 package utils
 
 import (
-	"github.com/gookit/config/v2"
-	"github.com/gookit/config/v2/yamlv3"
+	"github.com/ojgenbar/Colossus/common/config"
 )
 
 type Config struct {
-	S3      S3      `mapstructure:"s3"`
-	Servers Servers `mapstructure:"servers"`
-	Kafka   Kafka   `mapstructure:"kafka"`
-}
-
-type S3 struct {
-	Auth    S3Auth    `mapstructure:"auth"`
-	Buckets S3Buckets `mapstructure:"buckets"`
-}
-
-type S3Buckets struct {
-	Raw       S3Bucket `mapstructure:"raw"`
-	Processed S3Bucket `mapstructure:"processed"`
-}
-
-type S3Auth struct {
-	Endpoint        string `mapstructure:"endpoint"`
-	AccessKeyID     string `mapstructure:"accessKeyID"`
-	SecretAccessKey string `mapstructure:"secretAccessKey"`
-}
-
-type S3Bucket struct {
-	Name     string `mapstructure:"bucketName"`
-	Location string `mapstructure:"location"`
+	Storage config.Storage `mapstructure:"storage"`
+	S3      config.S3      `mapstructure:"s3"`
+	Servers Servers        `mapstructure:"servers"`
+	Queue   config.Queue   `mapstructure:"queue"`
+	Kafka   Kafka          `mapstructure:"kafka"`
+	Retry   Retry          `mapstructure:"retry"`
+	Workers Workers        `mapstructure:"workers"`
+	Convert Convert        `mapstructure:"convert"`
+	// Presets fill options of tasks which request a preset by name
+	Presets map[string]config.Preset `mapstructure:"presets"`
 }
 
 type Servers struct {
-	System Server `mapstructure:"system"`
-}
-
-type Server struct {
-	Addr string `mapstructure:"addr"`
+	System config.Server `mapstructure:"system"`
 }
 
 type Kafka struct {
 	BootstrapServers string `mapstructure:"bootstrap_servers"`
 	ClientId         string `mapstructure:"client_id"`
+	Acks             string `mapstructure:"acks"`
 	Topic            string `mapstructure:"topic"`
+	StatusTopic      string `mapstructure:"status_topic"`
+	ResultsTopic     string `mapstructure:"results_topic"`
+	DeadLetterTopic  string `mapstructure:"dead_letter_topic"`
 	GroupId          string `mapstructure:"group_id"`
 	SessionTimeoutMs int    `mapstructure:"session_timeout_ms"`
 	AutoOffsetReset  string `mapstructure:"auto_offset_reset"`
+	CommitIntervalMs int    `mapstructure:"commit_interval_ms"`
 }
 
-func LoadConfig() (*Config, error) {
-	var cfg Config
+type Retry struct {
+	MaxAttempts      int     `mapstructure:"max_attempts"`
+	InitialBackoffMs int     `mapstructure:"initial_backoff_ms"`
+	MaxBackoffMs     int     `mapstructure:"max_backoff_ms"`
+	Multiplier       float64 `mapstructure:"multiplier"`
+}
 
-	config.WithOptions(config.ParseEnv)
+type Workers struct {
+	Count       int `mapstructure:"count"`
+	MaxInFlight int `mapstructure:"max_in_flight"`
+	// MaxMemoryBytes limits raw and decoded images held by all workers together, 384MiB by default
+	MaxMemoryBytes int64 `mapstructure:"max_memory_bytes"`
+	// TaskMemoryBytes is the memory budget of a single task, MaxMemoryBytes by default
+	TaskMemoryBytes int64 `mapstructure:"task_memory_bytes"`
+	// TaskTimeoutMs limits decoding and converting in a single attempt, waiting for memory excluded, 2 minutes by default
+	TaskTimeoutMs int `mapstructure:"task_timeout_ms"`
+}
 
-	config.AddDriver(yamlv3.Driver)
+type Convert struct {
+	DefaultFilter string `mapstructure:"default_filter"`
+	// MaxPixels rejects raw images with more pixels before decoding them, 100 megapixels by default
+	MaxPixels int64 `mapstructure:"max_pixels"`
+	// MaxAnimationPixels rejects animated GIFs with more frames times pixels, 500 megapixels by default.
+	// Variants requesting a poster frame decode only the first one and are not limited by it.
+	MaxAnimationPixels int64 `mapstructure:"max_animation_pixels"`
+	// KeepSafeMetadata copies an allowlist of EXIF tags (camera, exposure, dates, copyright)
+	// to JPEG and PNG outputs, the metadata is stripped otherwise
+	KeepSafeMetadata bool `mapstructure:"keep_safe_metadata"`
+}
 
-	err := config.LoadFiles("configs/main.yml")
-	if err != nil {
-		return nil, err
-	}
+func LoadConfig() (*Config, error) {
+	var cfg Config
 
-	err = config.BindStruct("", &cfg)
+	err := config.Load("configs/main.yml", &cfg)
 	if err != nil {
 		return nil, err
 	}